@@ -3,8 +3,10 @@ module github.com/grafana/mqtt-datasource
 go 1.16
 
 require (
+	github.com/dop251/goja v0.0.0-20220405120441-9037c2b61cbf
 	github.com/eclipse/paho.mqtt.golang v1.3.4
 	github.com/fxamacker/cbor/v2 v2.3.0
 	github.com/grafana/grafana-plugin-sdk-go v0.104.0
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/stretchr/testify v1.7.0
 )
@@ -3,7 +3,9 @@ package mqtt
 import (
 	"fmt"
 	"math/rand"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
@@ -15,29 +17,92 @@ type Options struct {
 	Port     uint16 `json:"port"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+
+	// Seconds to keep a topic subscribed after its last consumer leaves.
+	GracePeriod int `json:"gracePeriod"`
+	// Seconds to remember received messages, dropping the ones received again. 0 disables it.
+	DeduplicationWindow int `json:"deduplicationWindow"`
 }
 
+// DefaultGracePeriod keeps the history of a topic between dashboard refreshes.
+const DefaultGracePeriod = 10 * 60
+
+// DefaultDeduplicationWindow covers QoS 1 redeliveries and the same uplink from several brokers.
+const DefaultDeduplicationWindow = 60
+
 type StreamMessage struct {
 	Topic string
 	Value string
 }
 
 type Client struct {
-	client paho.Client
-	topics TopicMap
-	stream chan StreamMessage
+	client      paho.Client
+	broker      string
+	username    string
+	topics      TopicMap
+	subscribers *Subscribers
+	gracePeriod time.Duration
+	dedup       *deduplicator
+	traffic     trafficCounter
+
+	// statusMu guards the result of the last connection to the broker.
+	statusMu       sync.Mutex
+	connecting     bool
+	connectStart   time.Time
+	connectLatency time.Duration
+	connectErr     error
+
+	// backoff between the attempts of the first connection, until done is closed.
+	backoff    time.Duration
+	maxBackoff time.Duration
+	done       chan struct{}
+
+	// mu guards the reference counts, release timers and messages of the topics.
+	mu       sync.Mutex
+	refs     map[string]int
+	timers   map[string]*time.Timer
+	disposed bool
+
+	// observedMu guards the MQTT topics seen on the broker.
+	observedMu sync.Mutex
+	observed   map[string]*ObservedTopic
+}
+
+// ObservedTopic is an MQTT topic seen on the broker.
+type ObservedTopic struct {
+	Topic    string    `json:"topic"`
+	Messages uint64    `json:"messages"`
+	LastSeen time.Time `json:"last_seen"`
 }
 
 //  Name of our default topic. TODO: Support other topics
-const defaultTopicName = "all"
+const DefaultTopic = "all"
 
 //  We will subscribe to all MQTT topics. TODO: Support other topics
 const defaultTopicMQTT = "#"
 
+//  Name of the topic for downlink events: down/queued, down/sent, down/ack, down/nack and down/failed
+const DownlinksTopic = "downlinks"
+
+//  Name of the topic for join events: join, with the join_accept of a device
+const JoinsTopic = "joins"
+
+//  Name of the topic for location events: location/solved, with the location of a device
+const LocationsTopic = "locations"
+
+//  Number of messages buffered for each stream subscriber
+const subscriberBufferSize = 1000
+
+//  Time to wait for the broker to accept a published message
+const publishTimeout = 10 * time.Second
+
+//  Maximum number of MQTT topics remembered as observed
+const maxObservedTopics = 10000
+
 func NewClient(o Options) (*Client, error) {
 	opts := paho.NewClientOptions()
 
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", o.Host, o.Port))
+	opts.AddBroker(brokerAddress(o))
 	opts.SetClientID(fmt.Sprintf("grafana_%d", rand.Int()))
 
 	if o.Username != "" {
@@ -52,24 +117,48 @@ func NewClient(o Options) (*Client, error) {
 	opts.SetKeepAlive(60 * time.Second)
 	opts.SetAutoReconnect(true)
 	opts.SetMaxReconnectInterval(10 * time.Second)
-	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
-		log.DefaultLogger.Error(fmt.Sprintf("MQTT Connection Lost: %s", err.Error()))
+	//  The handlers only run once connecting, after c is set
+	var c *Client
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		c.onConnectionLost(err)
 	})
-	opts.SetReconnectingHandler(func(c paho.Client, options *paho.ClientOptions) {
-		log.DefaultLogger.Debug("MQTT Reconnecting")
+	opts.SetReconnectingHandler(func(_ paho.Client, _ *paho.ClientOptions) {
+		c.onReconnecting()
+	})
+	opts.SetOnConnectHandler(func(_ paho.Client) {
+		c.onConnect()
 	})
 
 	log.DefaultLogger.Info("MQTT Connecting")
 
-	client := paho.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, fmt.Errorf("error connecting to MQTT broker: %s", token.Error())
-	}
+	//  Connect in the background, so the datasource works once the broker is reachable
+	c = newClient(paho.NewClient(opts), o)
+	c.setConnecting(true)
+	go c.connectLoop()
+
+	return c, nil
+}
+
+// brokerAddress returns the address of the broker in the options.
+func brokerAddress(o Options) string {
+	return fmt.Sprintf("tcp://%s:%d", o.Host, o.Port)
+}
 
+func newClient(client paho.Client, o Options) *Client {
 	return &Client{
-		client: client,
-		stream: make(chan StreamMessage, 1000),
-	}, nil
+		client:      client,
+		broker:      brokerAddress(o),
+		username:    o.Username,
+		subscribers: NewSubscribers(subscriberBufferSize),
+		gracePeriod: time.Duration(o.GracePeriod) * time.Second,
+		dedup:       newDeduplicator(time.Duration(o.DeduplicationWindow) * time.Second),
+		refs:        make(map[string]int),
+		timers:      make(map[string]*time.Timer),
+		observed:    make(map[string]*ObservedTopic),
+		backoff:     initialConnectBackoff,
+		maxBackoff:  maxConnectBackoff,
+		done:        make(chan struct{}),
+	}
 }
 
 func (c *Client) IsConnected() bool {
@@ -82,6 +171,8 @@ func (c *Client) IsSubscribed(path string) bool {
 }
 
 func (c *Client) Messages(path string) ([]Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	topic, ok := c.topics.Load(path)
 	if !ok {
 		return nil, ok
@@ -89,65 +180,193 @@ func (c *Client) Messages(path string) ([]Message, bool) {
 	return topic.messages, true
 }
 
-func (c *Client) Stream() chan StreamMessage {
-	return c.stream
+// Duplicates returns the messages of the topic that were dropped as duplicates.
+func (c *Client) Duplicates(path string) []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topic, ok := c.topics.Load(path)
+	if !ok {
+		return nil
+	}
+	return topic.duplicates
+}
+
+// storeDuplicate remembers a message dropped as a duplicate, so the duplicates
+// of each device can still be counted.
+func (c *Client) storeDuplicate(name string, message Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topic, ok := c.topics.Load(name)
+	if !ok {
+		return
+	}
+	topic.duplicates = append(topic.duplicates, message)
+
+	// limit the size of the retained duplicates
+	if len(topic.duplicates) > 1000 {
+		topic.duplicates = topic.duplicates[1:]
+	}
+}
+
+// ObservedTopics returns the MQTT topics seen on the broker, sorted by topic.
+func (c *Client) ObservedTopics() []ObservedTopic {
+	c.observedMu.Lock()
+	defer c.observedMu.Unlock()
+	topics := make([]ObservedTopic, 0, len(c.observed))
+	for _, topic := range c.observed {
+		topics = append(topics, *topic)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+	return topics
+}
+
+// observe records that a message was received on the MQTT topic.
+func (c *Client) observe(mqttTopic string, at time.Time) {
+	c.observedMu.Lock()
+	defer c.observedMu.Unlock()
+	topic, ok := c.observed[mqttTopic]
+	if !ok {
+		if len(c.observed) >= maxObservedTopics {
+			return
+		}
+		topic = &ObservedTopic{Topic: mqttTopic}
+		c.observed[mqttTopic] = topic
+	}
+	topic.Messages++
+	topic.LastSeen = at
+}
+
+// AddSubscriber creates a subscriber that receives every message streamed for the topic.
+func (c *Client) AddSubscriber(topic string) *Subscriber {
+	return c.subscribers.Add(topic)
+}
+
+// RemoveSubscriber stops streaming messages to the subscriber.
+func (c *Client) RemoveSubscriber(sub *Subscriber) {
+	c.subscribers.Remove(sub)
 }
 
 func (c *Client) HandleMessage(_ paho.Client, msg paho.Message) {
 	log.DefaultLogger.Debug(fmt.Sprintf("Received MQTT Message for topic %s", msg.Topic()))
-	//  Accept all topics as "all". TODO: Support other topics.
+	now := time.Now()
+	c.observe(msg.Topic(), now)
+	c.traffic.received(now)
+
+	//  Accept downlink events as "downlinks", join events as "joins", location events as "locations" and all other topics as "all". TODO: Support other topics.
 	//  Previously: topic, ok := c.topics.Load(msg.Topic())
-	topic, ok := c.topics.Load(defaultTopicName)
+	name, ok := topicName(msg.Topic())
 	if !ok {
-		log.DefaultLogger.Debug(fmt.Sprintf("Topic not found: %s", defaultTopicName))
+		log.DefaultLogger.Debug(fmt.Sprintf("Ignoring MQTT Message for topic %s", msg.Topic()))
+		c.traffic.rejected(now)
+		return
+	}
+	if !c.IsSubscribed(name) {
+		log.DefaultLogger.Debug(fmt.Sprintf("Topic not found: %s", name))
+		c.traffic.rejected(now)
 		return
 	}
 
 	//  Compose message
 	message := Message{
-		Timestamp: time.Now(),
+		Timestamp: now,
+		Topic:     msg.Topic(),
 		Value:     string(msg.Payload()),
 	}
 
-	//  TODO: Fix this hack to reject messages without a valid CBOR Base64 Payload.
-	//  CBOR Payloads must begin with a CBOR Map: 0xA1 or 0xA2 or 0xA3 or ...
-	//  So the Base64 Encoding must begin with "o" or "p" or "q" or ...
-	//  We stop at 0xB1 (Base64 "s") because we assume LoRaWAN Payloads will be under 50 bytes.
-	//  Join Messages don't have a payload and will also be rejected.
-	const frm_payload = "\"frm_payload\":\""
-	if !strings.Contains(message.Value, frm_payload+"o") &&
-		!strings.Contains(message.Value, frm_payload+"p") &&
-		!strings.Contains(message.Value, frm_payload+"q") &&
-		!strings.Contains(message.Value, frm_payload+"r") &&
-		!strings.Contains(message.Value, frm_payload+"s") {
+	if name == DefaultTopic && !hasUplinkPayload(message.Value) {
 		log.DefaultLogger.Debug(fmt.Sprintf("Missing or invalid payload: %s", message.Value))
+		c.traffic.rejected(now)
 		return
 	}
 
-	// store message for query
+	//  Drop the message if received again, e.g. through another broker or a QoS 1 redelivery
+	if c.dedup.duplicate(msg.Topic(), msg.Payload(), message.Timestamp) {
+		log.DefaultLogger.Debug(fmt.Sprintf("Dropping duplicate MQTT Message for topic %s", msg.Topic()))
+		c.traffic.rejected(now)
+		c.storeDuplicate(name, message)
+		return
+	}
+
+	// store message for query, unless the topic was dropped meanwhile
+	c.mu.Lock()
+	topic, ok := c.topics.Load(name)
+	if !ok {
+		c.mu.Unlock()
+		log.DefaultLogger.Debug(fmt.Sprintf("Topic not found: %s", name))
+		c.traffic.rejected(now)
+		return
+	}
 	topic.messages = append(topic.messages, message)
 
 	// limit the size of the retained messages
 	if len(topic.messages) > 1000 {
 		topic.messages = topic.messages[1:]
 	}
+	c.mu.Unlock()
 
-	c.topics.Store(topic)
-
-	//  Stream message to topic "all". TODO: Support other topics.
+	//  Stream message to topic "all", "downlinks", "joins" or "locations". TODO: Support other topics.
 	//  Previously: streamMessage := StreamMessage{Topic: msg.Topic(), Value: string(msg.Payload())}
-	streamMessage := StreamMessage{Topic: defaultTopicName, Value: string(msg.Payload())}
+	streamMessage := StreamMessage{Topic: name, Value: string(msg.Payload())}
+
+	log.DefaultLogger.Debug(fmt.Sprintf("Stream MQTT Message for topic %s", name))
+
+	// fan out to every stream without blocking
+	c.subscribers.Publish(streamMessage)
+}
+
+//  Return the name of the topic that stores the MQTT Message, based on the MQTT Topic:
+//  v3/{application id}@{tenant id}/devices/{device id}/{event}
+func topicName(mqttTopic string) (string, bool) {
+	switch {
+	//  Downlinks published by us
+	case strings.HasSuffix(mqttTopic, "/down/push"), strings.HasSuffix(mqttTopic, "/down/replace"):
+		return "", false
+
+	//  Downlink events
+	case strings.Contains(mqttTopic, "/down/"):
+		return DownlinksTopic, true
 
-	log.DefaultLogger.Debug(fmt.Sprintf("Stream MQTT Message for topic %s", defaultTopicName))
+	//  Join-accepts, which have no payload
+	case strings.HasSuffix(mqttTopic, "/join"):
+		return JoinsTopic, true
+
+	//  Locations solved by a geolocation service, which have no payload
+	case strings.HasSuffix(mqttTopic, "/location/solved"):
+		return LocationsTopic, true
 
-	select {
-	case c.stream <- streamMessage:
 	default:
-		// don't block if nothing is reading from the channel
+		return DefaultTopic, true
+	}
+}
+
+//  Return true if the message has a Payload, or a Payload decoded by The Things Network.
+//  The payload is decoded by the datasource, which picks the decoder for each device.
+//  Join Messages don't have a payload and will be rejected.
+func hasUplinkPayload(value string) bool {
+	const frm_payload = "\"frm_payload\":\""
+	idx := strings.Index(value, frm_payload)
+	if idx >= 0 && !strings.HasPrefix(value[idx+len(frm_payload):], "\"") {
+		return true
 	}
+	return strings.Contains(value, "\"decoded_payload\":")
 }
 
+// Subscribe adds a reference to the topic, subscribing to the broker on first use.
+// Every call must be paired with a call to Unsubscribe.
 func (c *Client) Subscribe(t string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.disposed {
+		return
+	}
+	c.refs[t]++
+	if timer, ok := c.timers[t]; ok {
+		// resubscribed within the grace period
+		timer.Stop()
+		delete(c.timers, t)
+	}
+
 	if _, ok := c.topics.Load(t); ok {
 		return
 	}
@@ -164,13 +383,85 @@ func (c *Client) Subscribe(t string) {
 	c.client.Subscribe(defaultTopicMQTT, 0, c.HandleMessage)
 }
 
+// Unsubscribe removes a reference to the topic. When the last reference is
+// removed, the topic and its history are dropped after the grace period.
 func (c *Client) Unsubscribe(t string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refs[t] == 0 {
+		return
+	}
+	c.refs[t]--
+	if c.refs[t] > 0 {
+		return
+	}
+	delete(c.refs, t)
+
+	if c.gracePeriod <= 0 {
+		c.remove(t)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(c.gracePeriod, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// skip if resubscribed or replaced by a newer timer
+		if c.timers[t] != timer || c.refs[t] > 0 {
+			return
+		}
+		delete(c.timers, t)
+		c.remove(t)
+	})
+	c.timers[t] = timer
+}
+
+// remove drops the topic, and the broker subscription once no topic is left.
+// Must be called with c.mu held.
+func (c *Client) remove(t string) {
 	log.DefaultLogger.Debug(fmt.Sprintf("Unsubscribing from MQTT topic: %s", t))
-	c.client.Unsubscribe(t)
 	c.topics.Delete(t)
+
+	//  All topics share the subscription to "#". TODO: Support other topics.
+	//  Previously: c.client.Unsubscribe(t)
+	if len(c.refs) == 0 && len(c.timers) == 0 {
+		c.client.Unsubscribe(defaultTopicMQTT)
+	}
+}
+
+// Publish sends the payload to the MQTT topic.
+func (c *Client) Publish(topic string, payload []byte) error {
+	log.DefaultLogger.Debug(fmt.Sprintf("Publishing to MQTT topic: %s", topic))
+	token := c.client.Publish(topic, 0, false, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timeout publishing to MQTT topic %s", topic)
+	}
+	return token.Error()
 }
 
+// Dispose stops connecting, drops the topics with their history and disconnects
+// from the broker. The client can't subscribe afterwards.
 func (c *Client) Dispose() {
+	c.mu.Lock()
+	if c.disposed {
+		c.mu.Unlock()
+		return
+	}
+	c.disposed = true
+	close(c.done)
+	for t, timer := range c.timers {
+		timer.Stop()
+		c.topics.Delete(t)
+	}
+	for t := range c.refs {
+		c.topics.Delete(t)
+	}
+	c.refs = make(map[string]int)
+	c.timers = make(map[string]*time.Timer)
+	c.mu.Unlock()
+
 	log.DefaultLogger.Info("MQTT Disconnecting")
 	c.client.Disconnect(250)
+	c.setConnecting(false)
 }
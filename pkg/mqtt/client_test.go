@@ -0,0 +1,326 @@
+package mqtt
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptionReferences(t *testing.T) {
+	t.Run("topic is kept until the last consumer leaves", func(t *testing.T) {
+		broker := &fakePahoClient{}
+		c := newClient(broker, Options{})
+
+		c.Subscribe("all")
+		c.Subscribe("all")
+		require.Equal(t, 1, broker.subscriptions())
+
+		c.Unsubscribe("all")
+		require.True(t, c.IsSubscribed("all"))
+		require.Equal(t, 0, broker.unsubscriptions())
+
+		c.Unsubscribe("all")
+		require.False(t, c.IsSubscribed("all"))
+		require.Equal(t, 1, broker.unsubscriptions())
+	})
+
+	t.Run("topic is kept for the grace period", func(t *testing.T) {
+		broker := &fakePahoClient{}
+		c := newClient(broker, Options{GracePeriod: 1})
+		c.gracePeriod = 20 * time.Millisecond
+
+		c.Subscribe("all")
+		c.Unsubscribe("all")
+		require.True(t, c.IsSubscribed("all"))
+
+		// resubscribing cancels the release
+		c.Subscribe("all")
+		time.Sleep(2 * c.gracePeriod)
+		require.True(t, c.IsSubscribed("all"))
+
+		c.Unsubscribe("all")
+		require.Eventually(t, func() bool { return !c.IsSubscribed("all") }, time.Second, time.Millisecond)
+		require.Equal(t, 1, broker.unsubscriptions())
+	})
+
+	t.Run("messages don't revive a dropped topic", func(t *testing.T) {
+		c := newClient(&fakePahoClient{}, Options{})
+		msg := &fakeMessage{topic: "v3/app@ttn/devices/tank-1/up", payload: `{"uplink_message":{"frm_payload":"oWF0GQTS"}}`}
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					c.HandleMessage(nil, msg)
+				}
+			}
+		}()
+		for idx := 0; idx < 1000; idx++ {
+			c.Subscribe("all")
+			c.Unsubscribe("all")
+		}
+		close(stop)
+		<-done
+
+		require.False(t, c.IsSubscribed("all"))
+		_, ok := c.Messages("all")
+		require.False(t, ok)
+	})
+
+	t.Run("unbalanced unsubscribe is ignored", func(t *testing.T) {
+		broker := &fakePahoClient{}
+		c := newClient(broker, Options{})
+
+		c.Unsubscribe("all")
+		require.Equal(t, 0, broker.unsubscriptions())
+	})
+}
+
+func TestDispose(t *testing.T) {
+	t.Run("topics are dropped and the broker disconnected", func(t *testing.T) {
+		broker := &fakePahoClient{}
+		c := newClient(broker, Options{GracePeriod: 1})
+		c.Subscribe("all")
+		c.Subscribe(DownlinksTopic)
+		c.Unsubscribe(DownlinksTopic)
+		c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/up", payload: `{"uplink_message":{"frm_payload":"oWF0GQTS"}}`})
+
+		subscriptions := broker.subscriptions()
+		c.Dispose()
+		require.Equal(t, 1, broker.disconnections())
+		require.False(t, c.IsConnected())
+		require.False(t, c.IsSubscribed("all"))
+		require.False(t, c.IsSubscribed(DownlinksTopic))
+		state, _ := c.State()
+		require.Equal(t, StateDisconnected, state)
+
+		// disposing again and subscribing afterwards are ignored
+		c.Dispose()
+		c.Subscribe("all")
+		c.Unsubscribe("all")
+		require.Equal(t, 1, broker.disconnections())
+		require.Equal(t, subscriptions, broker.subscriptions())
+		require.False(t, c.IsSubscribed("all"))
+	})
+
+	t.Run("no goroutine remains", func(t *testing.T) {
+		before := runtime.NumGoroutine()
+
+		broker := &fakePahoClient{down: true, failures: 1000}
+		c := newClient(broker, Options{GracePeriod: 1})
+		c.backoff = time.Millisecond
+		go c.connectLoop()
+		c.Subscribe("all")
+		c.Unsubscribe("all")
+		require.Eventually(t, func() bool { return broker.connections() > 1 }, time.Second, time.Millisecond)
+
+		c.Dispose()
+		requireGoroutines(t, before)
+	})
+}
+
+// requireGoroutines waits for the number of goroutines to drop to n.
+// require.Eventually can't be used, it runs the condition in a goroutine.
+func requireGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines remain, expected %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type fakePahoClient struct {
+	mu     sync.Mutex
+	subs   int
+	unsubs int
+	// down is true while the broker is unreachable, failures is the number of
+	// connection attempts that fail before the broker is reachable.
+	down        bool
+	failures    int
+	connects    int
+	disconnects int
+	// pending blocks the connection attempts until it is closed, like an unresponsive broker.
+	pending chan struct{}
+}
+
+func (c *fakePahoClient) connections() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connects
+}
+
+func (c *fakePahoClient) subscriptions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subs
+}
+
+func (c *fakePahoClient) unsubscriptions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unsubs
+}
+
+func (c *fakePahoClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.down
+}
+
+func (c *fakePahoClient) IsConnectionOpen() bool { return c.IsConnected() }
+
+func (c *fakePahoClient) Disconnect(_ uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = true
+	c.disconnects++
+}
+
+func (c *fakePahoClient) disconnections() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.disconnects
+}
+
+func (c *fakePahoClient) Connect() paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connects++
+	if c.connects <= c.failures {
+		return &fakeToken{err: errors.New("dial tcp: connection refused")}
+	}
+	if c.pending != nil {
+		return &pendingToken{done: c.pending}
+	}
+	c.down = false
+	return &fakeToken{}
+}
+
+func (c *fakePahoClient) Publish(_ string, _ byte, _ bool, _ interface{}) paho.Token {
+	return &fakeToken{}
+}
+
+func (c *fakePahoClient) Subscribe(_ string, _ byte, _ paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subs++
+	return &fakeToken{}
+}
+
+func (c *fakePahoClient) SubscribeMultiple(_ map[string]byte, _ paho.MessageHandler) paho.Token {
+	return &fakeToken{}
+}
+
+func (c *fakePahoClient) Unsubscribe(_ ...string) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsubs++
+	return &fakeToken{}
+}
+
+func (c *fakePahoClient) AddRoute(_ string, _ paho.MessageHandler) {}
+
+func (c *fakePahoClient) OptionsReader() paho.ClientOptionsReader {
+	return paho.ClientOptionsReader{}
+}
+
+// pendingToken completes when done is closed.
+type pendingToken struct {
+	done chan struct{}
+}
+
+func (t *pendingToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *pendingToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (t *pendingToken) Error() error          { return nil }
+func (t *pendingToken) Done() <-chan struct{} { return t.done }
+
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool                       { return true }
+func (t *fakeToken) WaitTimeout(_ time.Duration) bool { return true }
+func (t *fakeToken) Error() error                     { return t.err }
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func TestHandleMessage(t *testing.T) {
+	c := newClient(&fakePahoClient{}, Options{})
+	c.Subscribe("all")
+	c.Subscribe(DownlinksTopic)
+	c.Subscribe(JoinsTopic)
+	c.Subscribe(LocationsTopic)
+
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/up", payload: `{"uplink_message":{"frm_payload":"oWF0GQTS"}}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-2/up", payload: `{"uplink_message":{"frm_payload":"AWcBEA=="}}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-3/up", payload: `{"uplink_message":{"frm_payload":""}}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-4/up", payload: `{"uplink_message":{"decoded_payload":{"t":12.34}}}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/join", payload: `{"join_accept": {}}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/location/solved", payload: `{"location_solved": {}}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/down/push", payload: `{"downlinks": [{"frm_payload": "oWNsZWQB"}]}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/down/queued", payload: `{"downlink_queued": {}}`})
+
+	uplinks, ok := c.Messages("all")
+	require.True(t, ok)
+	require.Len(t, uplinks, 3)
+	require.Equal(t, "v3/app@ttn/devices/tank-1/up", uplinks[0].Topic)
+	require.Equal(t, "v3/app@ttn/devices/tank-2/up", uplinks[1].Topic)
+	require.Equal(t, "v3/app@ttn/devices/tank-4/up", uplinks[2].Topic)
+
+	downlinks, ok := c.Messages(DownlinksTopic)
+	require.True(t, ok)
+	require.Len(t, downlinks, 1)
+	require.Equal(t, "v3/app@ttn/devices/tank-1/down/queued", downlinks[0].Topic)
+
+	joins, ok := c.Messages(JoinsTopic)
+	require.True(t, ok)
+	require.Len(t, joins, 1)
+	require.Equal(t, "v3/app@ttn/devices/tank-1/join", joins[0].Topic)
+
+	locations, ok := c.Messages(LocationsTopic)
+	require.True(t, ok)
+	require.Len(t, locations, 1)
+	require.Equal(t, "v3/app@ttn/devices/tank-1/location/solved", locations[0].Topic)
+}
+
+type fakeMessage struct {
+	topic   string
+	payload string
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 0 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *fakeMessage) Ack()              {}
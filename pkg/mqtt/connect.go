@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"fmt"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// States of the connection to the broker.
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+)
+
+//  Delay before retrying the first connection to the broker, doubled after every failure
+const initialConnectBackoff = time.Second
+
+//  Maximum delay between the retries of the first connection to the broker
+const maxConnectBackoff = time.Minute
+
+//  Interval of the checks for Dispose while waiting for a connection to the broker
+const connectPoll = 100 * time.Millisecond
+
+// connectLoop connects to the broker, retrying with exponential backoff until it
+// succeeds or the client is disposed. Once connected, paho reconnects by itself.
+func (c *Client) connectLoop() {
+	backoff := c.backoff
+	for {
+		start := time.Now()
+		token := c.client.Connect()
+		if !c.waitConnect(token) {
+			//  Disposed while connecting: disconnect if paho connects after all
+			go func() {
+				if token.Wait() && token.Error() == nil {
+					c.client.Disconnect(250)
+				}
+			}()
+			return
+		}
+		err := token.Error()
+		c.setConnectResult(time.Since(start), err)
+		if err == nil {
+			log.DefaultLogger.Info(fmt.Sprintf("MQTT Connected to %s", c.broker))
+			//  Disposed while connecting, so nobody else disconnects
+			select {
+			case <-c.done:
+				c.client.Disconnect(250)
+			default:
+			}
+			return
+		}
+		log.DefaultLogger.Warn(fmt.Sprintf("error connecting to MQTT broker %s, retrying in %s: %s", c.broker, backoff, err.Error()))
+
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return
+		}
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// waitConnect waits for the connection attempt of the token, which can take as long
+// as the connect timeout of paho. Returns false if the client is disposed first.
+func (c *Client) waitConnect(token paho.Token) bool {
+	for !token.WaitTimeout(connectPoll) {
+		select {
+		case <-c.done:
+			return false
+		default:
+		}
+	}
+	return true
+}
+
+// onConnectionLost records the error of a lost connection, until paho reconnects.
+func (c *Client) onConnectionLost(err error) {
+	log.DefaultLogger.Error(fmt.Sprintf("MQTT Connection Lost: %s", err.Error()))
+	c.setConnectResult(0, err)
+}
+
+// onReconnecting records the start of an attempt of paho to reconnect to the broker.
+func (c *Client) onReconnecting() {
+	log.DefaultLogger.Debug("MQTT Reconnecting")
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.connecting = true
+	c.connectStart = time.Now()
+}
+
+// onConnect restores the subscription to all topics after a connection to the broker,
+// since the broker drops the subscriptions of a clean session.
+func (c *Client) onConnect() {
+	c.setConnected()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.refs) > 0 || len(c.timers) > 0 {
+		log.DefaultLogger.Debug(fmt.Sprintf("Subscribing to MQTT topic: %s", defaultTopicMQTT))
+		c.client.Subscribe(defaultTopicMQTT, 0, c.HandleMessage)
+	}
+}
+
+// setConnected clears the error of the last connection once connected, and records
+// the latency of a reconnection by paho. The first connection is recorded by connectLoop.
+func (c *Client) setConnected() {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.connecting = false
+	c.connectErr = nil
+	if !c.connectStart.IsZero() {
+		c.connectLatency = time.Since(c.connectStart)
+		c.connectStart = time.Time{}
+	}
+}
+
+// setConnecting records whether the client is connecting or reconnecting to the broker.
+func (c *Client) setConnecting(connecting bool) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.connecting = connecting
+}
+
+// State returns the state of the connection to the broker, and the error of the
+// last connection attempt.
+func (c *Client) State() (string, error) {
+	c.statusMu.Lock()
+	connecting, err := c.connecting, c.connectErr
+	c.statusMu.Unlock()
+
+	switch {
+	case c.IsConnected():
+		return StateConnected, nil
+	case connecting:
+		return StateConnecting, err
+	default:
+		return StateDisconnected, err
+	}
+}
@@ -0,0 +1,125 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectLoop(t *testing.T) {
+	t.Run("retries until the broker is reachable", func(t *testing.T) {
+		broker := &fakePahoClient{down: true, failures: 2}
+		c := newClient(broker, Options{})
+		c.backoff = time.Millisecond
+		c.setConnecting(true)
+
+		state, err := c.State()
+		require.Equal(t, StateConnecting, state)
+		require.NoError(t, err)
+
+		c.connectLoop()
+		require.Equal(t, 3, broker.connections())
+		state, err = c.State()
+		require.Equal(t, StateConnected, state)
+		require.NoError(t, err)
+	})
+
+	t.Run("reports the error while connecting", func(t *testing.T) {
+		broker := &fakePahoClient{down: true, failures: 1000}
+		c := newClient(broker, Options{})
+		c.backoff = time.Millisecond
+		c.maxBackoff = 4 * time.Millisecond
+		c.setConnecting(true)
+
+		done := make(chan struct{})
+		go func() {
+			c.connectLoop()
+			close(done)
+		}()
+		require.Eventually(t, func() bool { return broker.connections() > 3 }, time.Second, time.Millisecond)
+
+		state, err := c.State()
+		require.Equal(t, StateConnecting, state)
+		require.EqualError(t, err, "dial tcp: connection refused")
+		health := c.Health()
+		require.False(t, health.Connected)
+		require.Equal(t, StateConnecting, health.State)
+		require.Equal(t, "dial tcp: connection refused", health.Error)
+
+		// the loop stops when the client is disposed
+		close(c.done)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("connect loop didn't stop")
+		}
+	})
+}
+
+func TestDisposeWhileConnecting(t *testing.T) {
+	broker := &fakePahoClient{down: true, pending: make(chan struct{})}
+	c := newClient(broker, Options{})
+
+	done := make(chan struct{})
+	go func() {
+		c.connectLoop()
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return broker.connections() == 1 }, time.Second, time.Millisecond)
+
+	// the loop stops without waiting for the connection attempt
+	c.Dispose()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connect loop didn't stop")
+	}
+	require.Equal(t, 1, broker.disconnections())
+
+	// a connection that succeeds after all is closed
+	close(broker.pending)
+	require.Eventually(t, func() bool { return broker.disconnections() == 2 }, time.Second, time.Millisecond)
+}
+
+func TestReconnect(t *testing.T) {
+	broker := &fakePahoClient{}
+	c := newClient(broker, Options{})
+	c.setConnectResult(42*time.Millisecond, nil)
+
+	// paho reports the lost connection, then reconnects by itself
+	broker.down = true
+	c.onConnectionLost(errors.New("EOF"))
+	health := c.Health()
+	require.Equal(t, StateDisconnected, health.State)
+	require.Equal(t, "EOF", health.Error)
+	require.Zero(t, health.ConnectLatencyMs)
+
+	c.onReconnecting()
+	require.Equal(t, StateConnecting, c.Health().State)
+	time.Sleep(10 * time.Millisecond)
+	broker.down = false
+	c.onConnect()
+
+	health = c.Health()
+	require.Equal(t, StateConnected, health.State)
+	require.Empty(t, health.Error)
+	require.GreaterOrEqual(t, health.ConnectLatencyMs, int64(10))
+}
+
+func TestOnConnect(t *testing.T) {
+	broker := &fakePahoClient{down: true}
+	c := newClient(broker, Options{})
+
+	// subscribing while disconnected is restored once connected
+	c.Subscribe("all")
+	require.Equal(t, 1, broker.subscriptions())
+	c.onConnect()
+	require.Equal(t, 2, broker.subscriptions())
+
+	// nothing to restore without consumers
+	c.Unsubscribe("all")
+	c.onConnect()
+	require.Equal(t, 2, broker.subscriptions())
+}
@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//  Maximum number of messages remembered for de-duplication
+const maxDedupKeys = 100000
+
+// deduplicator drops messages that were already received within the window,
+// e.g. redelivered with QoS 1, or received twice through overlapping subscriptions.
+type deduplicator struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// keys in order of arrival, to expire them
+	keys []dedupKey
+}
+
+type dedupKey struct {
+	key string
+	at  time.Time
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// duplicate returns true if a message with the same identity was received on
+// the MQTT topic within the window. Otherwise the message is remembered.
+// Messages without identity are never duplicates.
+func (d *deduplicator) duplicate(mqttTopic string, payload []byte, now time.Time) bool {
+	if d == nil || d.window <= 0 {
+		return false
+	}
+	id := messageIdentity(payload)
+	if id == "" {
+		return false
+	}
+	key := mqttTopic + "\x00" + id
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now
+	d.keys = append(d.keys, dedupKey{key: key, at: now})
+	return false
+}
+
+// expire forgets the messages received before the window, and the oldest
+// ones above the limit. Must be called with d.mu held.
+func (d *deduplicator) expire(now time.Time) {
+	idx := 0
+	for idx < len(d.keys) && (now.Sub(d.keys[idx].at) >= d.window || len(d.keys)-idx >= maxDedupKeys) {
+		delete(d.seen, d.keys[idx].key)
+		idx++
+	}
+	if idx > 0 {
+		d.keys = append(d.keys[:0], d.keys[idx:]...)
+	}
+}
+
+//  Identifiers of a message at The Things Network
+type messageIDs struct {
+	EndDeviceIDs struct {
+		DevEUI string `json:"dev_eui"`
+	} `json:"end_device_ids"`
+	CorrelationIDs []string `json:"correlation_ids"`
+	UplinkMessage  *struct {
+		SessionKeyID string `json:"session_key_id"`
+		FCnt         uint64 `json:"f_cnt"`
+	} `json:"uplink_message"`
+}
+
+// messageIdentity identifies an uplink by (dev_eui, f_cnt, session_key_id), which
+// is the same through every broker, and other messages by their correlation_ids.
+// Returns an empty string if the message has neither.
+func messageIdentity(payload []byte) string {
+	var ids messageIDs
+	if err := json.Unmarshal(payload, &ids); err != nil {
+		return ""
+	}
+	if up := ids.UplinkMessage; up != nil && ids.EndDeviceIDs.DevEUI != "" {
+		return fmt.Sprintf("up:%s:%d:%s", ids.EndDeviceIDs.DevEUI, up.FCnt, up.SessionKeyID)
+	}
+	if len(ids.CorrelationIDs) > 0 {
+		sorted := append([]string(nil), ids.CorrelationIDs...)
+		sort.Strings(sorted)
+		return "ids:" + strings.Join(sorted, ",")
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageIdentity(t *testing.T) {
+	require.Equal(t, "up:70B3D57ED0000001:7:AYF3",
+		messageIdentity([]byte(`{"end_device_ids": {"dev_eui": "70B3D57ED0000001"}, "correlation_ids": ["as:up:1"], "uplink_message": {"session_key_id": "AYF3", "f_cnt": 7}}`)))
+	require.Equal(t, "ids:as:up:1,gs:uplink:2",
+		messageIdentity([]byte(`{"correlation_ids": ["gs:uplink:2", "as:up:1"], "downlink_queued": {}}`)))
+	require.Equal(t, "", messageIdentity([]byte(`{"uplink_message": {"f_cnt": 7}}`)))
+	require.Equal(t, "", messageIdentity([]byte(`not json`)))
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := newDeduplicator(time.Minute)
+	up := []byte(`{"end_device_ids": {"dev_eui": "70B3D57ED0000001"}, "uplink_message": {"session_key_id": "AYF3", "f_cnt": 7}}`)
+	start := time.Unix(1000, 0)
+
+	require.False(t, d.duplicate("v3/app@ttn/devices/tank-1/up", up, start))
+	require.True(t, d.duplicate("v3/app@ttn/devices/tank-1/up", up, start.Add(30*time.Second)))
+	// other events of the same uplink are not duplicates
+	require.False(t, d.duplicate("v3/app@ttn/devices/tank-1/up/other", up, start.Add(30*time.Second)))
+	// expired
+	require.False(t, d.duplicate("v3/app@ttn/devices/tank-1/up", up, start.Add(2*time.Minute)))
+	// messages without identity are kept
+	require.False(t, d.duplicate("test", []byte(`{"t": 1}`), start))
+	require.False(t, d.duplicate("test", []byte(`{"t": 1}`), start))
+
+	require.False(t, newDeduplicator(0).duplicate("v3/app@ttn/devices/tank-1/up", up, start))
+	require.False(t, newDeduplicator(0).duplicate("v3/app@ttn/devices/tank-1/up", up, start))
+}
+
+func TestHandleMessageDeduplication(t *testing.T) {
+	c := newClient(&fakePahoClient{}, Options{DeduplicationWindow: 60})
+	c.Subscribe("all")
+	sub := c.AddSubscriber("all")
+	defer c.RemoveSubscriber(sub)
+
+	first := `{"end_device_ids":{"device_id":"tank-1","dev_eui":"70B3D57ED0000001"},"uplink_message":{"f_cnt":7,"frm_payload":"oWF0GQTS"}}`
+	next := `{"end_device_ids":{"device_id":"tank-1","dev_eui":"70B3D57ED0000001"},"uplink_message":{"f_cnt":8,"frm_payload":"oWF0GQTS"}}`
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/up", payload: first})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/up", payload: first})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/up", payload: next})
+
+	uplinks, ok := c.Messages("all")
+	require.True(t, ok)
+	require.Len(t, uplinks, 2)
+	require.Equal(t, first, uplinks[0].Value)
+	require.Equal(t, next, uplinks[1].Value)
+	require.Len(t, sub.Messages(), 2)
+
+	// the dropped message is kept apart, to count the duplicates
+	duplicates := c.Duplicates("all")
+	require.Len(t, duplicates, 1)
+	require.Equal(t, first, duplicates[0].Value)
+}
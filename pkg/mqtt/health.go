@@ -0,0 +1,203 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+//  Number of minutes of traffic reported by the health check
+const trafficMinutes = 5
+
+//  Time to wait for the broker to grant the test subscription of the health check
+const healthTimeout = 5 * time.Second
+
+// Results of the authentication with the broker.
+const (
+	AuthenticationOK      = "ok"
+	AuthenticationFailed  = "failed"
+	AuthenticationUnknown = "unknown"
+)
+
+// Health is the state of the connection to the broker, reported by the health check.
+type Health struct {
+	// Address of the broker, e.g. tcp://au1.cloud.thethings.network:1883.
+	Broker    string `json:"broker"`
+	Connected bool   `json:"connected"`
+	// connecting, connected or disconnected.
+	State string `json:"state"`
+	// Time taken by the last connection to the broker.
+	ConnectLatencyMs int64 `json:"connectLatencyMs"`
+	// ok, failed or unknown if the broker wasn't reached.
+	Authentication string `json:"authentication"`
+	// Error of the last connection to the broker.
+	Error        string            `json:"error,omitempty"`
+	Subscription SubscriptionCheck `json:"subscription"`
+	Traffic      Traffic           `json:"traffic"`
+}
+
+// SubscriptionCheck is the result of a test subscription to the uplinks of the application.
+type SubscriptionCheck struct {
+	Topic   string `json:"topic"`
+	Granted bool   `json:"granted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Traffic counts the messages received from the broker in the last minutes.
+// Rejected messages are received but not stored, e.g. joins without payload or duplicates.
+type Traffic struct {
+	Minutes  int    `json:"minutes"`
+	Received uint64 `json:"received"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// trafficCounter counts the messages per minute, for the last trafficMinutes minutes.
+type trafficCounter struct {
+	mu      sync.Mutex
+	buckets [trafficMinutes]trafficBucket
+}
+
+type trafficBucket struct {
+	minute   int64
+	received uint64
+	rejected uint64
+}
+
+// bucket returns the bucket of the minute, reset if it holds an older minute.
+// Must be called with t.mu held.
+func (t *trafficCounter) bucket(at time.Time) *trafficBucket {
+	minute := at.Unix() / 60
+	b := &t.buckets[minute%trafficMinutes]
+	if b.minute != minute {
+		*b = trafficBucket{minute: minute}
+	}
+	return b
+}
+
+// received counts a message received at the time.
+func (t *trafficCounter) received(at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bucket(at).received++
+}
+
+// rejected counts a message received at the time but not stored.
+func (t *trafficCounter) rejected(at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bucket(at).rejected++
+}
+
+// traffic returns the messages counted in the last trafficMinutes minutes.
+func (t *trafficCounter) traffic(now time.Time) Traffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	traffic := Traffic{Minutes: trafficMinutes}
+	minute := now.Unix() / 60
+	for _, b := range t.buckets {
+		if b.minute > minute-trafficMinutes && b.minute <= minute {
+			traffic.Received += b.received
+			traffic.Rejected += b.rejected
+		}
+	}
+	return traffic
+}
+
+// authentication returns the result of the authentication from the connection error.
+func authentication(connected bool, err error) string {
+	if connected {
+		return AuthenticationOK
+	}
+	if err == nil {
+		return AuthenticationUnknown
+	}
+	//  paho doesn't wrap the CONNACK errors, so match them by text as well
+	for _, refused := range []error{packets.ErrorRefusedBadUsernameOrPassword, packets.ErrorRefusedNotAuthorised} {
+		if errors.Is(err, refused) || strings.Contains(err.Error(), refused.Error()) {
+			return AuthenticationFailed
+		}
+	}
+	return AuthenticationUnknown
+}
+
+// applicationTopic returns the MQTT topic of the uplinks of the application, from the
+// username of The Things Network: v3/{application id}@{tenant id}/devices/+/up
+func applicationTopic(username string) string {
+	if username == "" {
+		return defaultTopicMQTT
+	}
+	return fmt.Sprintf("v3/%s/devices/+/up", username)
+}
+
+// setConnectResult records the duration and error of a connection to the broker.
+func (c *Client) setConnectResult(latency time.Duration, err error) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.connectLatency = latency
+	c.connectErr = err
+}
+
+// Health checks the connection to the broker: the result of the last connection, a test
+// subscription to the uplinks of the application and the traffic of the last minutes.
+func (c *Client) Health() Health {
+	c.statusMu.Lock()
+	latency, err := c.connectLatency, c.connectErr
+	c.statusMu.Unlock()
+	state, _ := c.State()
+
+	health := Health{
+		Broker:           c.broker,
+		Connected:        state == StateConnected,
+		State:            state,
+		ConnectLatencyMs: latency.Milliseconds(),
+		Traffic:          c.traffic.traffic(time.Now()),
+		Subscription:     SubscriptionCheck{Topic: applicationTopic(c.username)},
+	}
+	health.Authentication = authentication(health.Connected, err)
+	if err != nil {
+		health.Error = err.Error()
+	}
+	if health.Connected {
+		health.Subscription.Granted, health.Subscription.Error = c.testSubscription(health.Subscription.Topic)
+	}
+	return health
+}
+
+// testSubscription subscribes to the topic and unsubscribes again.
+// Returns true if the broker granted the subscription, or else the error.
+func (c *Client) testSubscription(topic string) (bool, string) {
+	//  Subscribing replaces the handler of the topic, so keep ours for "#"
+	handler := func(_ paho.Client, _ paho.Message) {}
+	if topic == defaultTopicMQTT {
+		handler = c.HandleMessage
+	}
+	token := c.client.Subscribe(topic, 0, handler)
+	granted, reason := true, ""
+	switch {
+	case !token.WaitTimeout(healthTimeout):
+		granted, reason = false, "timeout waiting for the broker"
+	case token.Error() != nil:
+		granted, reason = false, token.Error().Error()
+	default:
+		//  Subscriptions refused by the ACL of the broker return the failure code 0x80
+		if sub, ok := token.(*paho.SubscribeToken); ok {
+			if qos, ok := sub.Result()[topic]; ok && qos == 0x80 {
+				granted, reason = false, "subscription refused by the broker"
+			}
+		}
+	}
+
+	//  Keep the subscription if the topic is also used to receive the messages
+	c.mu.Lock()
+	inUse := topic == defaultTopicMQTT && (len(c.refs) > 0 || len(c.timers) > 0)
+	c.mu.Unlock()
+	if !inUse {
+		c.client.Unsubscribe(topic).WaitTimeout(healthTimeout)
+	}
+	return granted, reason
+}
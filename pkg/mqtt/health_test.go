@@ -0,0 +1,65 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficCounter(t *testing.T) {
+	var counter trafficCounter
+	start := time.Unix(6000, 0)
+
+	counter.received(start)
+	counter.received(start.Add(30 * time.Second))
+	counter.rejected(start.Add(30 * time.Second))
+	counter.received(start.Add(3 * time.Minute))
+	require.Equal(t, Traffic{Minutes: 5, Received: 3, Rejected: 1}, counter.traffic(start.Add(4*time.Minute)))
+
+	// the first minute is out of the window
+	require.Equal(t, Traffic{Minutes: 5, Received: 1}, counter.traffic(start.Add(5*time.Minute)))
+
+	// the bucket of the first minute is reused
+	counter.received(start.Add(5 * time.Minute))
+	require.Equal(t, Traffic{Minutes: 5, Received: 2}, counter.traffic(start.Add(5*time.Minute)))
+	require.Equal(t, Traffic{Minutes: 5}, counter.traffic(start.Add(time.Hour)))
+}
+
+func TestAuthentication(t *testing.T) {
+	require.Equal(t, AuthenticationOK, authentication(true, nil))
+	require.Equal(t, AuthenticationUnknown, authentication(false, nil))
+	require.Equal(t, AuthenticationFailed, authentication(false, packets.ErrorRefusedBadUsernameOrPassword))
+	require.Equal(t, AuthenticationFailed, authentication(false, fmt.Errorf("%s : EOF", packets.ErrorRefusedNotAuthorised)))
+	require.Equal(t, AuthenticationUnknown, authentication(false, errors.New("dial tcp: connection refused")))
+}
+
+func TestHealth(t *testing.T) {
+	broker := &fakePahoClient{}
+	c := newClient(broker, Options{Host: "au1.cloud.thethings.network", Port: 1883, Username: "luppy-application@ttn"})
+	c.setConnectResult(42*time.Millisecond, nil)
+	c.Subscribe("all")
+
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/up", payload: `{"uplink_message":{"frm_payload":"oWF0GQTS"}}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/join", payload: `{"join_accept": {}}`})
+	c.HandleMessage(nil, &fakeMessage{topic: "v3/app@ttn/devices/tank-1/up", payload: `{"uplink_message":{"frm_payload":""}}`})
+
+	health := c.Health()
+	require.Equal(t, Health{
+		Broker:           "tcp://au1.cloud.thethings.network:1883",
+		Connected:        true,
+		State:            StateConnected,
+		ConnectLatencyMs: 42,
+		Authentication:   AuthenticationOK,
+		Subscription:     SubscriptionCheck{Topic: "v3/luppy-application@ttn/devices/+/up", Granted: true},
+		Traffic:          Traffic{Minutes: 5, Received: 3, Rejected: 2},
+	}, health)
+
+	// the test subscription is removed, the subscription to # is kept
+	require.Equal(t, 2, broker.subscriptions())
+	require.Equal(t, 1, broker.unsubscriptions())
+	require.True(t, c.IsSubscribed("all"))
+}
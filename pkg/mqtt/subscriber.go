@@ -0,0 +1,104 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// Subscriber receives the messages streamed for a topic.
+type Subscriber struct {
+	topic    string
+	messages chan StreamMessage
+	dropped  uint64
+}
+
+// Topic returns the topic of the subscriber.
+func (s *Subscriber) Topic() string {
+	return s.topic
+}
+
+// Messages returns the channel of messages for the subscriber.
+// The channel is closed when the subscriber is removed.
+func (s *Subscriber) Messages() <-chan StreamMessage {
+	return s.messages
+}
+
+// Dropped returns the number of messages dropped because the subscriber's buffer was full.
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Subscribers fans out the streamed messages of a topic to every subscriber of the topic.
+// Each subscriber has its own buffer, so a slow subscriber only drops its own messages.
+type Subscribers struct {
+	mu   sync.RWMutex
+	subs map[string]map[*Subscriber]struct{}
+	size int
+}
+
+// NewSubscribers creates a fan-out with the given buffer size per subscriber.
+func NewSubscribers(size int) *Subscribers {
+	return &Subscribers{
+		subs: make(map[string]map[*Subscriber]struct{}),
+		size: size,
+	}
+}
+
+// Add creates a subscriber for the topic.
+func (s *Subscribers) Add(topic string) *Subscriber {
+	sub := &Subscriber{
+		topic:    topic,
+		messages: make(chan StreamMessage, s.size),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[topic]; !ok {
+		s.subs[topic] = make(map[*Subscriber]struct{})
+	}
+	s.subs[topic][sub] = struct{}{}
+	return sub
+}
+
+// Remove removes the subscriber and closes its channel.
+func (s *Subscribers) Remove(sub *Subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs, ok := s.subs[sub.topic]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(s.subs, sub.topic)
+	}
+	close(sub.messages)
+}
+
+// Count returns the number of subscribers for the topic.
+func (s *Subscribers) Count(topic string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.subs[topic])
+}
+
+// Publish sends the message to every subscriber of its topic without blocking.
+// Subscribers with a full buffer drop the message.
+func (s *Subscribers) Publish(msg StreamMessage) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for sub := range s.subs[msg.Topic] {
+		select {
+		case sub.messages <- msg:
+		default:
+			dropped := atomic.AddUint64(&sub.dropped, 1)
+			log.DefaultLogger.Debug(fmt.Sprintf("Subscriber buffer full for topic %s, dropped %d messages", msg.Topic, dropped))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package mqtt_test
+
+import (
+	"testing"
+
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribers(t *testing.T) {
+	t.Run("every subscriber of the topic receives the message", func(t *testing.T) {
+		subscribers := mqtt.NewSubscribers(10)
+		first := subscribers.Add("all")
+		second := subscribers.Add("all")
+		other := subscribers.Add("other")
+
+		subscribers.Publish(mqtt.StreamMessage{Topic: "all", Value: "1"})
+
+		require.Equal(t, "1", (<-first.Messages()).Value)
+		require.Equal(t, "1", (<-second.Messages()).Value)
+		require.Len(t, other.Messages(), 0)
+	})
+
+	t.Run("full buffers drop messages per subscriber", func(t *testing.T) {
+		subscribers := mqtt.NewSubscribers(1)
+		slow := subscribers.Add("all")
+		fast := subscribers.Add("all")
+
+		subscribers.Publish(mqtt.StreamMessage{Topic: "all", Value: "1"})
+		<-fast.Messages()
+		subscribers.Publish(mqtt.StreamMessage{Topic: "all", Value: "2"})
+
+		require.Equal(t, uint64(1), slow.Dropped())
+		require.Equal(t, uint64(0), fast.Dropped())
+		require.Equal(t, "2", (<-fast.Messages()).Value)
+	})
+
+	t.Run("remove closes the subscriber", func(t *testing.T) {
+		subscribers := mqtt.NewSubscribers(1)
+		sub := subscribers.Add("all")
+		subscribers.Remove(sub)
+		subscribers.Remove(sub)
+
+		_, ok := <-sub.Messages()
+		require.False(t, ok)
+		require.Equal(t, 0, subscribers.Count("all"))
+	})
+}
@@ -7,12 +7,15 @@ import (
 
 type Message struct {
 	Timestamp time.Time
+	Topic     string
 	Value     string
 }
 
 type Topic struct {
 	path     string
 	messages []Message
+	// messages dropped as duplicates, for the packet loss analysis
+	duplicates []Message
 }
 
 type TopicMap struct {
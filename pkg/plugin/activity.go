@@ -0,0 +1,202 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+)
+
+// ttnJoin is a message published to join, when a device joins the network.
+type ttnJoin struct {
+	EndDeviceIDs ttnEndDeviceIDs `json:"end_device_ids"`
+	ReceivedAt   time.Time       `json:"received_at"`
+	JoinAccept   *struct {
+		SessionKeyID string    `json:"session_key_id"`
+		ReceivedAt   time.Time `json:"received_at"`
+	} `json:"join_accept"`
+}
+
+// join is a join-accept of a device.
+type join struct {
+	timestamp time.Time
+	ids       ttnEndDeviceIDs
+	sessionID string
+}
+
+// parseJoins returns the join-accepts in the messages, in order of arrival.
+// The timestamp is the time the network received the join, if known.
+func parseJoins(messages []mqtt.Message) []join {
+	joins := make([]join, 0, len(messages))
+	for _, m := range messages {
+		var event ttnJoin
+		if err := json.Unmarshal([]byte(m.Value), &event); err != nil {
+			log.DefaultLogger.Debug(fmt.Sprintf("parseJoins: Decode error %s", err.Error()))
+			continue
+		}
+		if event.JoinAccept == nil || event.EndDeviceIDs.DeviceID == "" {
+			continue
+		}
+
+		timestamp := m.Timestamp
+		switch {
+		case !event.JoinAccept.ReceivedAt.IsZero():
+			timestamp = event.JoinAccept.ReceivedAt
+		case !event.ReceivedAt.IsZero():
+			timestamp = event.ReceivedAt
+		}
+		joins = append(joins, join{
+			timestamp: timestamp,
+			ids:       event.EndDeviceIDs,
+			sessionID: event.JoinAccept.SessionKeyID,
+		})
+	}
+	return joins
+}
+
+// inTimeRange returns true if the time is in the range. An empty range contains any time.
+func inTimeRange(t time.Time, tr backend.TimeRange) bool {
+	if tr.From.IsZero() && tr.To.IsZero() {
+		return true
+	}
+	return !t.Before(tr.From) && !t.After(tr.To)
+}
+
+// joinFrame returns a frame with one row per join-accept in the time range,
+// with the identifiers and the new address and session of the device.
+func joinFrame(name string, messages []mqtt.Message, tr backend.TimeRange) *data.Frame {
+	joins := make([]join, 0)
+	for _, j := range parseJoins(messages) {
+		if inTimeRange(j.timestamp, tr) {
+			joins = append(joins, j)
+		}
+	}
+	sort.SliceStable(joins, func(i, j int) bool {
+		return joins[i].timestamp.Before(joins[j].timestamp)
+	})
+
+	count := len(joins)
+	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, count)
+	timeField.Name = "Time"
+	deviceField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	deviceField.Name = "device_id"
+	devEUIField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	devEUIField.Name = "dev_eui"
+	joinEUIField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	joinEUIField.Name = "join_eui"
+	devAddrField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	devAddrField.Name = "dev_addr"
+	sessionField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	sessionField.Name = "session_key_id"
+
+	for row, j := range joins {
+		timeField.Set(row, j.timestamp)
+		deviceField.Set(row, j.ids.DeviceID)
+		devEUIField.Set(row, j.ids.DevEUI)
+		joinEUIField.Set(row, j.ids.JoinEUI)
+		devAddrField.Set(row, j.ids.DevAddr)
+		sessionField.Set(row, j.sessionID)
+	}
+
+	return data.NewFrame(name, timeField, deviceField, devEUIField, joinEUIField, devAddrField, sessionField)
+}
+
+// deviceActivity is the activity of a device seen in the uplinks or joins.
+type deviceActivity struct {
+	deviceID string
+	devEUI   string
+	lastSeen time.Time
+	lastFCnt uint64
+	uplinks  int64
+	lastJoin time.Time
+}
+
+// deviceActivityFrame returns a frame with one row per device: the time and frame
+// counter of the last uplink, the number of uplinks in the time range, the seconds
+// since the last uplink and the time of the last join. Devices that only joined
+// have no uplink.
+func deviceActivityFrame(name string, uplinks []mqtt.Message, joins []mqtt.Message, tr backend.TimeRange, now time.Time) *data.Frame {
+	devices := make(map[string]*deviceActivity)
+	device := func(ids ttnEndDeviceIDs) *deviceActivity {
+		d, ok := devices[ids.DeviceID]
+		if !ok {
+			d = &deviceActivity{deviceID: ids.DeviceID}
+			devices[ids.DeviceID] = d
+		}
+		if ids.DevEUI != "" {
+			d.devEUI = ids.DevEUI
+		}
+		return d
+	}
+
+	for _, m := range uplinks {
+		var uplink ttnUplink
+		if err := json.Unmarshal([]byte(m.Value), &uplink); err != nil {
+			log.DefaultLogger.Debug(fmt.Sprintf("deviceActivityFrame: Decode error %s", err.Error()))
+			continue
+		}
+		if uplink.EndDeviceIDs.DeviceID == "" {
+			continue
+		}
+		d := device(uplink.EndDeviceIDs)
+		if !m.Timestamp.Before(d.lastSeen) {
+			d.lastSeen = m.Timestamp
+			d.lastFCnt = uplink.UplinkMessage.FCnt
+		}
+		if inTimeRange(m.Timestamp, tr) {
+			d.uplinks++
+		}
+	}
+	for _, j := range parseJoins(joins) {
+		d := device(j.ids)
+		if j.timestamp.After(d.lastJoin) {
+			d.lastJoin = j.timestamp
+		}
+	}
+
+	list := make([]*deviceActivity, 0, len(devices))
+	for _, d := range devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].deviceID < list[j].deviceID
+	})
+
+	count := len(list)
+	deviceField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	deviceField.Name = "device_id"
+	devEUIField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	devEUIField.Name = "dev_eui"
+	lastSeenField := data.NewFieldFromFieldType(data.FieldTypeNullableTime, count)
+	lastSeenField.Name = "last_seen"
+	fCntField := data.NewFieldFromFieldType(data.FieldTypeNullableUint64, count)
+	fCntField.Name = "last_f_cnt"
+	uplinksField := data.NewFieldFromFieldType(data.FieldTypeInt64, count)
+	uplinksField.Name = "uplinks"
+	sinceField := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, count)
+	sinceField.Name = "seconds_since_last_uplink"
+	sinceField.Config = &data.FieldConfig{Unit: "s"}
+	lastJoinField := data.NewFieldFromFieldType(data.FieldTypeNullableTime, count)
+	lastJoinField.Name = "last_join"
+
+	for row, d := range list {
+		deviceField.Set(row, d.deviceID)
+		devEUIField.Set(row, d.devEUI)
+		if !d.lastSeen.IsZero() {
+			lastSeenField.SetConcrete(row, d.lastSeen)
+			fCntField.SetConcrete(row, d.lastFCnt)
+			sinceField.SetConcrete(row, now.Sub(d.lastSeen).Seconds())
+		}
+		uplinksField.Set(row, d.uplinks)
+		if !d.lastJoin.IsZero() {
+			lastJoinField.SetConcrete(row, d.lastJoin)
+		}
+	}
+
+	return data.NewFrame(name, deviceField, devEUIField, lastSeenField, fCntField, uplinksField, sinceField, lastJoinField)
+}
@@ -0,0 +1,122 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinsAndActivity(t *testing.T) {
+	client := &fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"all": {
+				{Timestamp: time.Unix(100, 0), Value: `{"end_device_ids": {"device_id": "tank-1", "dev_eui": "70B3D57ED0000001"}, "uplink_message": {"f_cnt": 7, "frm_payload": "oWF0GQTS"}}`},
+				{Timestamp: time.Unix(200, 0), Value: `{"end_device_ids": {"device_id": "tank-2"}, "uplink_message": {"f_cnt": 3, "frm_payload": "oWF0GQTS"}}`},
+				{Timestamp: time.Unix(300, 0), Value: `{"end_device_ids": {"device_id": "tank-1"}, "uplink_message": {"f_cnt": 8, "frm_payload": "oWF0GQTS"}}`},
+				{Timestamp: time.Unix(400, 0), Value: `{"plain": "json"}`},
+			},
+			"joins": {
+				{Timestamp: time.Unix(50, 0), Value: `{
+					"end_device_ids": {"device_id": "tank-1", "dev_eui": "70B3D57ED0000001", "join_eui": "0000000000000000", "dev_addr": "260B1234"},
+					"join_accept": {"session_key_id": "AYF3", "received_at": "1970-01-01T00:00:40Z"}
+				}`},
+				{Timestamp: time.Unix(250, 0), Value: `{
+					"end_device_ids": {"device_id": "tank-3", "dev_eui": "70B3D57ED0000003", "dev_addr": "260B5678"},
+					"join_accept": {"session_key_id": "AYF4"}
+				}`},
+				{Timestamp: time.Unix(260, 0), Value: `{"end_device_ids": {"device_id": "tank-4"}}`},
+			},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	t.Run("joins in the time range", func(t *testing.T) {
+		res := ds.Query(backend.DataQuery{
+			QueryType: "joins",
+			JSON:      []byte(`{}`),
+			TimeRange: backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(1000, 0)},
+		})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+
+		frame := res.Frames[0]
+		require.Equal(t, 2, frame.Rows())
+		require.Equal(t, []interface{}{int64(40), int64(250)}, unix([]interface{}{frame.Fields[0].At(0), frame.Fields[0].At(1)}))
+		field := fieldByName(frame, "device_id")
+		require.Equal(t, "tank-1", field.At(0))
+		require.Equal(t, "tank-3", field.At(1))
+		field = fieldByName(frame, "dev_addr")
+		require.Equal(t, "260B1234", field.At(0))
+		field = fieldByName(frame, "session_key_id")
+		require.Equal(t, "AYF4", field.At(1))
+
+		res = ds.Query(backend.DataQuery{
+			QueryType: "joins",
+			JSON:      []byte(`{}`),
+			TimeRange: backend.TimeRange{From: time.Unix(100, 0), To: time.Unix(1000, 0)},
+		})
+		require.NoError(t, res.Error)
+		require.Equal(t, 1, res.Frames[0].Rows())
+	})
+
+	t.Run("activity of each device", func(t *testing.T) {
+		res := ds.Query(backend.DataQuery{
+			QueryType: "activity",
+			JSON:      []byte(`{}`),
+			TimeRange: backend.TimeRange{From: time.Unix(150, 0), To: time.Unix(1000, 0)},
+		})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+
+		frame := res.Frames[0]
+		require.Equal(t, 3, frame.Rows())
+
+		column := func(name string) []interface{} {
+			field := fieldByName(frame, name)
+			require.NotNil(t, field, name)
+			values := make([]interface{}, field.Len())
+			for idx := range values {
+				if val, ok := field.ConcreteAt(idx); ok {
+					values[idx] = val
+				}
+			}
+			return values
+		}
+		require.Equal(t, []interface{}{"tank-1", "tank-2", "tank-3"}, column("device_id"))
+		require.Equal(t, []interface{}{"70B3D57ED0000001", "", "70B3D57ED0000003"}, column("dev_eui"))
+		require.Equal(t, []interface{}{int64(300), int64(200), nil}, unix(column("last_seen")))
+		require.Equal(t, []interface{}{uint64(8), uint64(3), nil}, column("last_f_cnt"))
+		require.Equal(t, []interface{}{int64(1), int64(1), int64(0)}, column("uplinks"))
+		require.Equal(t, []interface{}{int64(40), nil, int64(250)}, unix(column("last_join")))
+
+		since := column("seconds_since_last_uplink")
+		require.InDelta(t, time.Since(time.Unix(300, 0)).Seconds(), since[0], 60)
+		require.Nil(t, since[2])
+	})
+}
+
+// unix converts the times to Unix seconds, so times parsed in UTC and local times compare equal.
+func unix(values []interface{}) []interface{} {
+	for idx, val := range values {
+		if t, ok := val.(time.Time); ok {
+			values[idx] = t.Unix()
+		}
+	}
+	return values
+}
+
+// fieldByName returns the first field of the frame with the name, or nil.
+func fieldByName(frame *data.Frame, name string) *data.Field {
+	for _, field := range frame.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
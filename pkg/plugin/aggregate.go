@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// AggregateFunc aggregates the values of a field in a time bucket.
+type AggregateFunc string
+
+const (
+	AggregateMean  AggregateFunc = "mean"
+	AggregateMin   AggregateFunc = "min"
+	AggregateMax   AggregateFunc = "max"
+	AggregateLast  AggregateFunc = "last"
+	AggregateCount AggregateFunc = "count"
+	AggregateSum   AggregateFunc = "sum"
+)
+
+// Aggregation downsamples the decoded records into time buckets.
+type Aggregation struct {
+	// Function applied to every field, mean by default.
+	Function AggregateFunc `json:"function,omitempty"`
+	// Functions for individual fields, overriding Function.
+	Fields map[string]AggregateFunc `json:"fields,omitempty"`
+	// Aggregate each device separately instead of all devices together.
+	GroupByDevice bool `json:"groupByDevice,omitempty"`
+}
+
+// validate returns an error if the aggregation has an unknown function.
+func (a *Aggregation) validate() error {
+	if a == nil {
+		return nil
+	}
+	if err := validateAggregateFunc(a.Function); err != nil {
+		return err
+	}
+	for _, fn := range a.Fields {
+		if err := validateAggregateFunc(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAggregateFunc(fn AggregateFunc) error {
+	switch fn {
+	case "", AggregateMean, AggregateMin, AggregateMax, AggregateLast, AggregateCount, AggregateSum:
+		return nil
+	}
+	return fmt.Errorf("unknown aggregate function: %s", fn)
+}
+
+// function returns the aggregate function for the field.
+func (a *Aggregation) function(key string) AggregateFunc {
+	if fn, ok := a.Fields[key]; ok && fn != "" {
+		return fn
+	}
+	if a.Function != "" {
+		return a.Function
+	}
+	return AggregateMean
+}
+
+// bucketInterval returns the width of the aggregation buckets for the query:
+// the query interval, widened so the time range has at most MaxDataPoints buckets.
+func bucketInterval(query backend.DataQuery) time.Duration {
+	interval := query.Interval
+	if query.MaxDataPoints > 0 {
+		span := query.TimeRange.To.Sub(query.TimeRange.From)
+		if minimum := span / time.Duration(query.MaxDataPoints); minimum > interval {
+			interval = minimum
+		}
+	}
+	return interval
+}
+
+// bucket accumulates the values of the records in a time bucket, for one device or all of them.
+type bucket struct {
+	start   time.Time
+	records []record
+}
+
+// aggregateRecords downsamples the records into buckets of the interval, one record
+// per bucket (and per device if grouped), timestamped with the start of the bucket.
+// Records are returned unchanged if there is no aggregation or interval.
+func aggregateRecords(records []record, agg *Aggregation, interval time.Duration) []record {
+	if agg == nil || interval <= 0 {
+		return records
+	}
+
+	type bucketKey struct {
+		start  int64
+		device string
+	}
+	keys := make([]bucketKey, 0)
+	buckets := make(map[bucketKey]*bucket)
+	for _, r := range records {
+		// align the buckets to the Unix epoch, like Grafana's intervals
+		nanos := r.timestamp.UnixNano()
+		start := time.Unix(0, nanos-nanos%int64(interval))
+		key := bucketKey{start: start.UnixNano()}
+		if agg.GroupByDevice {
+			key.device = r.labels.String()
+		}
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{start: start}
+			buckets[key] = b
+			keys = append(keys, key)
+		}
+		b.records = append(b.records, r)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].start != keys[j].start {
+			return keys[i].start < keys[j].start
+		}
+		return keys[i].device < keys[j].device
+	})
+
+	aggregated := make([]record, 0, len(keys))
+	for _, key := range keys {
+		aggregated = append(aggregated, buckets[key].aggregate(agg))
+	}
+	return aggregated
+}
+
+// aggregate returns a record with the aggregated value of each field in the bucket.
+// The labels are kept if all records in the bucket have the same labels.
+func (b *bucket) aggregate(agg *Aggregation) record {
+	labels, _ := commonLabels(b.records)
+	out := record{
+		timestamp: b.start,
+		body:      make(map[string]interface{}),
+		labels:    labels,
+	}
+
+	// values of each field, in order of arrival
+	values := make(map[string][]interface{})
+	for _, r := range b.records {
+		for key, val := range r.body {
+			values[key] = append(values[key], val)
+		}
+	}
+
+	for key, vals := range values {
+		if val := aggregateValues(agg.function(key), vals); val != nil {
+			out.body[key] = val
+		}
+	}
+	return out
+}
+
+// aggregateValues applies the function to the values of a field. Count and last
+// accept any type, the other functions only numbers. Returns nil if nothing to aggregate.
+func aggregateValues(fn AggregateFunc, vals []interface{}) interface{} {
+	switch fn {
+	case AggregateCount:
+		return uint64(len(vals))
+	case AggregateLast:
+		return vals[len(vals)-1]
+	}
+
+	numbers := make([]float64, 0, len(vals))
+	for _, val := range vals {
+		if number, ok := normalize(val).(float64); ok {
+			numbers = append(numbers, number)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	result := numbers[0]
+	switch fn {
+	case AggregateMin:
+		for _, number := range numbers[1:] {
+			if number < result {
+				result = number
+			}
+		}
+	case AggregateMax:
+		for _, number := range numbers[1:] {
+			if number > result {
+				result = number
+			}
+		}
+	case AggregateSum, AggregateMean:
+		for _, number := range numbers[1:] {
+			result += number
+		}
+		if fn == AggregateMean {
+			result /= float64(len(numbers))
+		}
+	}
+	return result
+}
@@ -0,0 +1,98 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregation(t *testing.T) {
+	messages := []mqtt.Message{
+		{Timestamp: time.Unix(0, 0), Value: uplink(t, "tank-1", map[string]interface{}{"l": 1000, "state": "low"})},
+		{Timestamp: time.Unix(20, 0), Value: uplink(t, "tank-2", map[string]interface{}{"l": 2000, "state": "high"})},
+		{Timestamp: time.Unix(40, 0), Value: uplink(t, "tank-1", map[string]interface{}{"l": 3000, "state": "high"})},
+		{Timestamp: time.Unix(70, 0), Value: uplink(t, "tank-1", map[string]interface{}{"l": 4000, "state": "low"})},
+	}
+
+	values := func(t *testing.T, frame *data.Frame, name string) []interface{} {
+		for _, field := range frame.Fields {
+			if field.Name != name {
+				continue
+			}
+			vals := make([]interface{}, field.Len())
+			for row := range vals {
+				if val, ok := field.ConcreteAt(row); ok {
+					vals[row] = val
+				}
+			}
+			return vals
+		}
+		t.Fatalf("no field %s", name)
+		return nil
+	}
+
+	t.Run("functions", func(t *testing.T) {
+		tests := []struct {
+			function plugin.AggregateFunc
+			values   []interface{}
+		}{
+			{function: "", values: []interface{}{2000.0, 4000.0}},
+			{function: plugin.AggregateMean, values: []interface{}{2000.0, 4000.0}},
+			{function: plugin.AggregateMin, values: []interface{}{1000.0, 4000.0}},
+			{function: plugin.AggregateMax, values: []interface{}{3000.0, 4000.0}},
+			{function: plugin.AggregateSum, values: []interface{}{6000.0, 4000.0}},
+			{function: plugin.AggregateCount, values: []interface{}{3.0, 1.0}},
+			{function: plugin.AggregateLast, values: []interface{}{3000.0, 4000.0}},
+		}
+		for _, tt := range tests {
+			frames := plugin.ToFrames("all", messages, plugin.FrameOptions{
+				Aggregation: &plugin.Aggregation{Function: tt.function, Fields: map[string]plugin.AggregateFunc{"state": plugin.AggregateLast}},
+				Interval:    time.Minute,
+			})
+			require.Len(t, frames, 1)
+			require.Equal(t, []interface{}{time.Unix(0, 0), time.Unix(60, 0)}, values(t, frames[0], "Time"), tt.function)
+			require.Equal(t, tt.values, values(t, frames[0], "l"), tt.function)
+			require.Equal(t, []interface{}{"high", "low"}, values(t, frames[0], "state"), tt.function)
+		}
+	})
+
+	t.Run("group by device", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{
+			Layout:      plugin.FrameLayoutWide,
+			Aggregation: &plugin.Aggregation{Function: plugin.AggregateMax, GroupByDevice: true},
+			Interval:    time.Minute,
+		})
+		require.Len(t, frames, 1)
+		frame := frames[0]
+		require.Equal(t, 3, frame.Rows())
+		require.Equal(t, []string{"Time", "l", "l"}, fieldNames(frame))
+		require.Equal(t, deviceLabels("tank-1"), frame.Fields[1].Labels)
+		require.Equal(t, []interface{}{3000.0, nil, 4000.0}, values(t, frame, "l"))
+	})
+
+	t.Run("query", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			connected: true,
+			messages:  map[string][]mqtt.Message{"all": messages},
+		}, "xyz")
+
+		query := backend.DataQuery{
+			JSON:          []byte(`{"queryText": "all", "aggregation": {"function": "count"}}`),
+			Interval:      time.Second,
+			MaxDataPoints: 2,
+			TimeRange:     backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(120, 0)},
+		}
+		res := ds.Query(query)
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		require.Equal(t, []interface{}{3.0, 1.0}, values(t, res.Frames[0], "l"))
+
+		query.JSON = []byte(`{"queryText": "all", "aggregation": {"function": "median"}}`)
+		require.Error(t, ds.Query(query).Error)
+	})
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// alertHeader is set by Grafana on the queries of alert rule evaluations.
+const alertHeader = "FromAlert"
+
+// defaultStaleAfter is the maximum age of the last value of a device kept by an alert
+// rule evaluation when the device didn't send in the time range.
+const defaultStaleAfter = time.Hour
+
+// alertPoint is a value of a field of a device, as a number.
+type alertPoint struct {
+	timestamp time.Time
+	value     float64
+}
+
+// alertSeries is the time series of a field of a device.
+type alertSeries struct {
+	name   string
+	labels data.Labels
+	// points in the time range
+	points []alertPoint
+	// last point before the time range
+	last *alertPoint
+}
+
+// alertValue returns the value as a number. Booleans are 1 or 0, other values
+// can't be evaluated by an alert rule.
+func alertValue(val interface{}) (float64, bool) {
+	switch v := normalize(val).(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// alertFrames returns the records as numeric time series for alert rules: one frame
+// per device and field, with a Time field and a float64 field labelled by the device.
+// Only the points in the time range are returned, but a series without points in the
+// time range keeps its last value if it is at most staleAfter older than the range,
+// so a device that sends less often than the rule evaluates doesn't flip to no data.
+// Older series are dropped with a notice per device, so the rule sees no data.
+// Points after the time range are ignored.
+func alertFrames(topic string, records []record, tr backend.TimeRange, staleAfter time.Duration, opts FrameOptions) data.Frames {
+	sorted := append([]record(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].timestamp.Before(sorted[j].timestamp)
+	})
+
+	series := make(map[string]*alertSeries)
+	var lastSeen time.Time
+	for _, r := range sorted {
+		if !tr.To.IsZero() && r.timestamp.After(tr.To) {
+			continue
+		}
+		lastSeen = r.timestamp
+		for key, val := range r.body {
+			value, ok := alertValue(val)
+			if !ok {
+				continue
+			}
+			id := key + r.labels.String()
+			s, ok := series[id]
+			if !ok {
+				s = &alertSeries{name: key, labels: r.labels}
+				series[id] = s
+			}
+			point := alertPoint{timestamp: r.timestamp, value: value}
+			if r.timestamp.Before(tr.From) {
+				s.last = &point
+				continue
+			}
+			s.points = append(s.points, point)
+		}
+	}
+
+	if len(series) == 0 {
+		frame := data.NewFrame(topic)
+		if lastSeen.IsZero() {
+			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityInfo, Text: "no uplinks received"})
+		} else {
+			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityInfo, Text: fmt.Sprintf("no numeric fields since %s", lastSeen.UTC().Format(time.RFC3339))})
+		}
+		return data.Frames{frame}
+	}
+
+	ids := make([]string, 0, len(series))
+	for id := range series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	frames := make(data.Frames, 0, len(ids))
+	stale := make(map[string]time.Time)
+	var staleDevices []string
+	for _, id := range ids {
+		s := series[id]
+		points := s.points
+		if len(points) == 0 && s.last != nil {
+			if tr.From.Sub(s.last.timestamp) > staleAfter {
+				device := s.labels["device_id"]
+				if device == "" {
+					device = s.labels.String()
+				}
+				if at, ok := stale[device]; !ok {
+					staleDevices = append(staleDevices, device)
+					stale[device] = s.last.timestamp
+				} else if s.last.timestamp.After(at) {
+					stale[device] = s.last.timestamp
+				}
+				continue
+			}
+			points = []alertPoint{*s.last}
+		}
+
+		timeField := data.NewFieldFromFieldType(data.FieldTypeTime, len(points))
+		timeField.Name = "Time"
+		valueField := data.NewFieldFromFieldType(data.FieldTypeFloat64, len(points))
+		valueField.Name = s.name
+		valueField.Labels = s.labels
+		for row, point := range points {
+			timeField.Set(row, point.timestamp)
+			valueField.Set(row, point.value)
+		}
+		frame := data.NewFrame(topic, timeField, valueField)
+		frames = append(frames, select_fields(applyProfiles(frame, opts.Profiles), opts.Fields))
+	}
+
+	if len(frames) == 0 {
+		frames = data.Frames{data.NewFrame(topic)}
+	}
+	sort.Strings(staleDevices)
+	for _, device := range staleDevices {
+		frames[0].AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     fmt.Sprintf("%s: no data since %s", device, stale[device].UTC().Format(time.RFC3339)),
+		})
+	}
+	return frames
+}
@@ -0,0 +1,152 @@
+package plugin_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+// evaluateAlert sends the query like an alert rule evaluation of Grafana.
+func evaluateAlert(t *testing.T, ds *plugin.MQTTDatasource, json string, from, to int64) backend.DataResponse {
+	res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Headers: map[string]string{"FromAlert": "true"},
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      []byte(json),
+			TimeRange: backend.TimeRange{From: time.Unix(from, 0), To: time.Unix(to, 0)},
+		}},
+	})
+	require.NoError(t, err)
+	return res.Responses["A"]
+}
+
+// series returns the name, device and values of the numeric series of each frame.
+func series(t *testing.T, frames data.Frames) map[string][]float64 {
+	values := make(map[string][]float64)
+	for _, frame := range frames {
+		require.Len(t, frame.Fields, 2)
+		require.Equal(t, data.FieldTypeTime, frame.Fields[0].Type())
+		field := frame.Fields[1]
+		require.Equal(t, data.FieldTypeFloat64, field.Type())
+		key := field.Name + "/" + field.Labels["device_id"]
+		for idx := 0; idx < field.Len(); idx++ {
+			values[key] = append(values[key], field.At(idx).(float64))
+		}
+	}
+	return values
+}
+
+func TestAlertEvaluation(t *testing.T) {
+	client := &fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"all": {
+				// tank-1 sends every minute
+				{Timestamp: time.Unix(60, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1200, "ok": true, "state": "idle"})},
+				{Timestamp: time.Unix(120, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1250, "ok": false})},
+				{Timestamp: time.Unix(180, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1300, "ok": true})},
+				// tank-2 went silent before the time range
+				{Timestamp: time.Unix(10, 0), Value: uplink(t, "tank-2", map[string]interface{}{"t": 900})},
+				{Timestamp: time.Unix(20, 0), Value: uplink(t, "tank-2", map[string]interface{}{"t": 950})},
+				// after the time range
+				{Timestamp: time.Unix(600, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 9999})},
+			},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	t.Run("numeric series per device in the time range", func(t *testing.T) {
+		res := evaluateAlert(t, ds, `{"queryText": "all"}`, 100, 300)
+		require.NoError(t, res.Error)
+		require.Equal(t, map[string][]float64{
+			"ok/tank-1": {0, 1},
+			"t/tank-1":  {1250, 1300},
+			"t/tank-2":  {950},
+		}, series(t, res.Frames))
+
+		for _, frame := range res.Frames {
+			require.Nil(t, frame.Meta, "alert frames have no stream channel")
+		}
+	})
+
+	t.Run("last value of a silent device", func(t *testing.T) {
+		res := evaluateAlert(t, ds, `{"queryText": "all"}`, 200, 300)
+		require.NoError(t, res.Error)
+		require.Equal(t, map[string][]float64{
+			"ok/tank-1": {1},
+			"t/tank-1":  {1300},
+			"t/tank-2":  {950},
+		}, series(t, res.Frames))
+		for _, frame := range res.Frames {
+			if frame.Fields[1].Labels["device_id"] == "tank-2" {
+				require.Equal(t, time.Unix(20, 0), frame.Fields[0].At(0))
+			}
+		}
+	})
+
+	t.Run("last value of a stale device", func(t *testing.T) {
+		// tank-2 sent 180s before the time range
+		res := evaluateAlert(t, ds, `{"queryText": "all", "staleAfter": 100}`, 200, 300)
+		require.NoError(t, res.Error)
+		require.Equal(t, map[string][]float64{
+			"ok/tank-1": {1},
+			"t/tank-1":  {1300},
+		}, series(t, res.Frames))
+		require.Equal(t, []data.Notice{
+			{Severity: data.NoticeSeverityInfo, Text: "tank-2: no data since 1970-01-01T00:00:20Z"},
+		}, res.Frames[0].Meta.Notices)
+
+		res = evaluateAlert(t, ds, `{"queryText": "all", "staleAfter": 200}`, 200, 300)
+		require.NoError(t, res.Error)
+		require.Equal(t, []float64{950}, series(t, res.Frames)["t/tank-2"])
+	})
+
+	t.Run("all devices stale", func(t *testing.T) {
+		res := evaluateAlert(t, ds, `{"queryText": "all", "staleAfter": 100}`, 1000, 1100)
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		require.Empty(t, res.Frames[0].Fields)
+		require.Equal(t, []data.Notice{
+			{Severity: data.NoticeSeverityInfo, Text: "tank-1: no data since 1970-01-01T00:10:00Z"},
+			{Severity: data.NoticeSeverityInfo, Text: "tank-2: no data since 1970-01-01T00:00:20Z"},
+		}, res.Frames[0].Meta.Notices)
+	})
+
+	t.Run("query options", func(t *testing.T) {
+		res := evaluateAlert(t, ds, `{
+			"queryText": "all",
+			"filter": "device_id == \"tank-1\"",
+			"fields": [{"name": "t", "alias": "temperature", "unit": "celsius"}]
+		}`, 100, 300)
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		field := res.Frames[0].Fields[1]
+		require.Equal(t, "temperature", field.Name)
+		require.Equal(t, "celsius", field.Config.Unit)
+		require.Equal(t, "tank-1", field.Labels["device_id"])
+		require.Equal(t, 2, field.Len())
+	})
+
+	t.Run("no data", func(t *testing.T) {
+		res := evaluateAlert(t, ds, `{"queryText": "all"}`, 0, 5)
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		require.Empty(t, res.Frames[0].Fields)
+		require.Equal(t, "no uplinks received", res.Frames[0].Meta.Notices[0].Text)
+	})
+
+	t.Run("panels are not affected", func(t *testing.T) {
+		res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"queryText": "all"}`)}},
+		})
+		require.NoError(t, err)
+		require.Len(t, res.Responses["A"].Frames, 1)
+		require.Equal(t, "ds/xyz/all", res.Responses["A"].Frames[0].Meta.Channel)
+	})
+}
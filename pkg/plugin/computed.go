@@ -0,0 +1,64 @@
+package plugin
+
+import "fmt"
+
+// ComputedField is a field computed from the decoded fields of each record, e.g.
+//
+//	temperature = t / 100
+//	level = (v - 500) * 0.2
+//
+// The expression uses the filter language with the arithmetic operators + - * / %.
+type ComputedField struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+
+	expr exprNode
+}
+
+// compile parses the expression of the computed field.
+func (c *ComputedField) compile() error {
+	if c.Name == "" {
+		return fmt.Errorf("computed field %q has no name", c.Expression)
+	}
+	expr, err := parseExpr(c.Expression)
+	if err != nil {
+		return fmt.Errorf("invalid expression for computed field %s: %w", c.Name, err)
+	}
+	c.expr = expr
+	return nil
+}
+
+// CompileComputedFields returns a copy of the computed fields with their expressions parsed.
+func CompileComputedFields(fields []ComputedField) ([]ComputedField, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	compiled := make([]ComputedField, len(fields))
+	for idx, field := range fields {
+		if err := field.compile(); err != nil {
+			return nil, err
+		}
+		compiled[idx] = field
+	}
+	return compiled, nil
+}
+
+// computeFields adds the computed fields to the body of each record, in order, so a
+// computed field can use the ones before it. Missing results (e.g. the record doesn't
+// have a field used by the expression) are left out.
+func computeFields(records []record, fields []ComputedField) []record {
+	if len(fields) == 0 {
+		return records
+	}
+	for _, r := range records {
+		for _, field := range fields {
+			if field.expr == nil {
+				continue
+			}
+			if val := field.expr.eval(r); val != nil {
+				r.body[field.Name] = val
+			}
+		}
+	}
+	return records
+}
@@ -0,0 +1,122 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputedFields(t *testing.T) {
+	messages := []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 2345, "v": 1500})},
+		{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})},
+	}
+
+	computed, err := plugin.CompileComputedFields([]plugin.ComputedField{
+		{Name: "temperature", Expression: "t / 100"},
+		{Name: "level", Expression: "(v - 500) * 0.2"},
+		{Name: "hot", Expression: "temperature > 20"},
+		{Name: "negative", Expression: "-t % 1000"},
+	})
+	require.NoError(t, err)
+
+	t.Run("frame", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Computed: computed})
+		require.Len(t, frames, 1)
+		frame := frames[0]
+		require.Equal(t, []string{"Time", "hot", "level", "negative", "t", "temperature", "v"}, fieldNames(frame))
+
+		row := func(idx int) []interface{} {
+			vals := make([]interface{}, 0, len(frame.Fields)-1)
+			for _, field := range frame.Fields[1:] {
+				val, ok := field.ConcreteAt(idx)
+				if !ok {
+					val = nil
+				}
+				vals = append(vals, val)
+			}
+			return vals
+		}
+		require.Equal(t, []interface{}{true, 200.0, -345.0, 2345.0, 23.45, 1500.0}, row(0))
+		require.Equal(t, []interface{}{false, nil, -234.0, 1234.0, 12.34, nil}, row(1))
+	})
+
+	t.Run("selected with filter", func(t *testing.T) {
+		filter, err := plugin.ParseFilter("temperature > 20")
+		require.NoError(t, err)
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{
+			Computed: computed[:1],
+			Fields:   []plugin.FieldSelection{{Name: "v"}},
+			Filter:   filter,
+		})
+		require.Len(t, frames, 1)
+		require.Equal(t, []string{"Time", "v", "temperature"}, fieldNames(frames[0]))
+		require.Equal(t, 1, frames[0].Rows())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, field := range []plugin.ComputedField{
+			{Name: "x", Expression: "t /"},
+			{Name: "x", Expression: "(t + 1"},
+			{Name: "", Expression: "t"},
+		} {
+			_, err := plugin.CompileComputedFields([]plugin.ComputedField{field})
+			require.Error(t, err, field.Expression)
+		}
+
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{connected: true}, "xyz")
+		res := ds.Query(backend.DataQuery{
+			JSON: []byte(`{"queryText": "all", "computed": [{"name": "x", "expression": "t * * 2"}]}`),
+		})
+		require.Error(t, res.Error)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		client := &fakeMQTTClient{
+			connected:  true,
+			subscribed: true,
+			streams:    mqtt.NewSubscribers(10),
+		}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+		sender := &fakePacketSender{packets: make(chan *backend.StreamPacket, 10)}
+
+		options := `{"queryText":"all","computed":[{"name":"temperature","expression":"t / 100"}],"filter":"temperature > 20"}`
+		path := "all/" + base64.RawURLEncoding.EncodeToString([]byte(options))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(sender))
+		}()
+
+		require.Eventually(t, func() bool { return client.streams.Count("all") == 1 }, time.Second, time.Millisecond)
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})})
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 2345})})
+
+		var frame struct {
+			Schema struct {
+				Fields []struct {
+					Name string `json:"name"`
+				} `json:"fields"`
+			} `json:"schema"`
+			Data struct {
+				Values [][]interface{} `json:"values"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(sender.next(t).Data, &frame))
+		require.Len(t, frame.Schema.Fields, 3)
+		require.Equal(t, "temperature", frame.Schema.Fields[2].Name)
+		require.Equal(t, []interface{}{23.45}, frame.Data.Values[2], fmt.Sprint(frame.Data.Values))
+
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
@@ -1,9 +1,13 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -20,20 +24,53 @@ func NewMQTTInstance(s backend.DataSourceInstanceSettings) (instancemgmt.Instanc
 		return nil, err
 	}
 
-	client, err := mqtt.NewClient(*settings)
+	// the client connects in the background, so the instance is created
+	// even if the broker is unreachable; see CheckHealth and QueryData.
+	client, err := mqtt.NewClient(settings.Options)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewMQTTDatasource(client, s.UID), nil
+	ds := NewMQTTDatasource(client, s.UID)
+	ds.Settings = *settings
+
+	// buffer the messages from the start and for the lifetime of the instance,
+	// so queries see the history even without a grace period, and alert rules
+	// evaluated by a new instance don't have to wait for a panel to subscribe.
+	for _, topic := range []string{mqtt.DefaultTopic, mqtt.DownlinksTopic, mqtt.JoinsTopic, mqtt.LocationsTopic} {
+		ds.subscribe(topic)
+	}
+	return ds, nil
+}
+
+// Settings of the datasource instance.
+type Settings struct {
+	mqtt.Options
+
+	// Allow publishing downlinks from Grafana Live.
+	EnableDownlinks bool `json:"enableDownlinks"`
+	// Minimum Grafana role required to publish downlinks. Defaults to Editor.
+	DownlinkRole string `json:"downlinkRole"`
+	// Decoders of the uplink payloads, by f_port, device ID or DevEUI. CBOR by default.
+	Decoders []DecoderRule `json:"decoders"`
+	// Display metadata of the decoded fields by type of device.
+	Profiles []DeviceProfile `json:"profiles"`
 }
 
-func getDatasourceSettings(s backend.DataSourceInstanceSettings) (*mqtt.Options, error) {
-	settings := &mqtt.Options{}
+func getDatasourceSettings(s backend.DataSourceInstanceSettings) (*Settings, error) {
+	settings := &Settings{
+		Options: mqtt.Options{
+			GracePeriod:         mqtt.DefaultGracePeriod,
+			DeduplicationWindow: mqtt.DefaultDeduplicationWindow,
+		},
+	}
 
 	if err := json.Unmarshal(s.JSONData, settings); err != nil {
 		return nil, err
 	}
+	if _, ok := roles[settings.DownlinkRole]; settings.DownlinkRole != "" && !ok {
+		return nil, fmt.Errorf("invalid downlink role %q: must be Viewer, Editor or Admin", settings.DownlinkRole)
+	}
 
 	if password, exists := s.DecryptedSecureJSONData["password"]; exists {
 		settings.Password = password
@@ -43,17 +80,37 @@ func getDatasourceSettings(s backend.DataSourceInstanceSettings) (*mqtt.Options,
 }
 
 type MQTTClient interface {
-	Stream() chan mqtt.StreamMessage
+	AddSubscriber(topic string) *mqtt.Subscriber
+	RemoveSubscriber(sub *mqtt.Subscriber)
 	IsConnected() bool
+	State() (string, error)
 	IsSubscribed(topic string) bool
 	Messages(topic string) ([]mqtt.Message, bool)
+	Duplicates(topic string) []mqtt.Message
 	Subscribe(topic string)
 	Unsubscribe(topic string)
+	Publish(topic string, payload []byte) error
+	ObservedTopics() []mqtt.ObservedTopic
+	Health() mqtt.Health
+	Dispose()
 }
 
 type MQTTDatasource struct {
 	Client        MQTTClient
+	Settings      Settings
 	channelPrefix string
+
+	// topics subscribed for the lifetime of the instance
+	subscriptions []string
+
+	// mu guards disposed. done is closed on Dispose, to stop the
+	// streams of the instance, which are counted by streams.
+	mu       sync.Mutex
+	disposed bool
+	done     chan struct{}
+	streams  sync.WaitGroup
+
+	resourceHandler backend.CallResourceHandler
 }
 
 // Make sure MQTTDatasource implements required interfaces.
@@ -63,88 +120,391 @@ var (
 	_ backend.QueryDataHandler      = (*MQTTDatasource)(nil)
 	_ backend.CheckHealthHandler    = (*MQTTDatasource)(nil)
 	_ backend.StreamHandler         = (*MQTTDatasource)(nil)
+	_ backend.CallResourceHandler   = (*MQTTDatasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*MQTTDatasource)(nil)
 )
 
 // NewMQTTDatasource creates a new datasource instance.
 func NewMQTTDatasource(client MQTTClient, uid string) *MQTTDatasource {
-	return &MQTTDatasource{
+	ds := &MQTTDatasource{
 		Client:        client,
 		channelPrefix: fmt.Sprintf("ds/%s/", uid),
+		done:          make(chan struct{}),
 	}
+	ds.resourceHandler = newResourceHandler(ds)
+	return ds
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources
 // when a new instance created. As soon as datasource settings change detected
 // by SDK old datasource instance will be disposed and a new one will be created
 // using NewMQTTDatasource factory function.
+//
+// Dispose stops the streams of the instance, then disconnects the client.
+// Nothing is persisted, so the buffered uplinks are dropped with the client.
 func (ds *MQTTDatasource) Dispose() {
-	// Nothing to clean up yet.
+	ds.mu.Lock()
+	if ds.disposed {
+		ds.mu.Unlock()
+		return
+	}
+	ds.disposed = true
+	close(ds.done)
+	ds.mu.Unlock()
+
+	ds.streams.Wait()
+	for _, topic := range ds.subscriptions {
+		ds.Client.Unsubscribe(topic)
+	}
+	ds.subscriptions = nil
+	ds.Client.Dispose()
+}
+
+// startStream counts a stream of the instance, unless the instance is disposed.
+func (ds *MQTTDatasource) startStream() bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.disposed {
+		return false
+	}
+	ds.streams.Add(1)
+	return true
+}
+
+// subscribe keeps the topic subscribed until the instance is disposed.
+func (ds *MQTTDatasource) subscribe(topic string) {
+	ds.Client.Subscribe(topic)
+	ds.subscriptions = append(ds.subscriptions, topic)
 }
 
 func (ds *MQTTDatasource) QueryData(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	response := backend.NewQueryDataResponse()
 
+	alerting := req.Headers[alertHeader] == "true"
+	state, err := ds.Client.State()
 	for _, q := range req.Queries {
-		res := ds.Query(q)
+		res := ds.query(q, alerting)
+		if state != mqtt.StateConnected && res.Error == nil {
+			res.Frames = withConnectionNotice(res.Frames, state, err)
+		}
 		response.Responses[q.RefID] = res
 	}
 
 	return response, nil
 }
 
+// withConnectionNotice adds a warning to the first frame that the broker is not
+// connected, so the uplinks may be missing.
+func withConnectionNotice(frames data.Frames, state string, err error) data.Frames {
+	text := fmt.Sprintf("MQTT %s, uplinks received meanwhile are missing", state)
+	if err != nil {
+		text = fmt.Sprintf("%s: %s", text, err.Error())
+	}
+	if len(frames) == 0 {
+		frames = data.Frames{data.NewFrame("")}
+	}
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     text,
+	})
+	return frames
+}
+
+// CallResource serves the resource endpoints used by the query editor.
+func (ds *MQTTDatasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	return ds.resourceHandler.CallResource(ctx, req, sender)
+}
+
+// CheckHealth reports the connection to the broker, with the broker address, connect
+// latency, authentication, test subscription and recent traffic in the JSON details.
 func (ds *MQTTDatasource) CheckHealth(_ context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	if !ds.Client.IsConnected() {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: "MQTT Disconnected",
-		}, nil
+	health := ds.Client.Health()
+	details, err := json.Marshal(health)
+	if err != nil {
+		return nil, err
 	}
 
-	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "MQTT Connected",
-	}, nil
+	result := &backend.CheckHealthResult{
+		Status:      backend.HealthStatusOk,
+		Message:     "MQTT Connected",
+		JSONDetails: details,
+	}
+	switch {
+	case !health.Connected && health.Authentication == mqtt.AuthenticationFailed:
+		result.Status = backend.HealthStatusError
+		result.Message = "MQTT Disconnected: authentication failed"
+	case health.State == mqtt.StateConnecting && health.Error != "":
+		result.Status = backend.HealthStatusError
+		result.Message = fmt.Sprintf("MQTT Connecting: %s", health.Error)
+	case health.State == mqtt.StateConnecting:
+		result.Status = backend.HealthStatusError
+		result.Message = "MQTT Connecting"
+	case !health.Connected:
+		result.Status = backend.HealthStatusError
+		result.Message = "MQTT Disconnected"
+	case !health.Subscription.Granted:
+		result.Status = backend.HealthStatusError
+		result.Message = fmt.Sprintf("MQTT Connected, but subscribing to %s failed: %s", health.Subscription.Topic, health.Subscription.Error)
+	}
+	return result, nil
 }
 
 func (ds *MQTTDatasource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	qm, err := parseStreamPath(req.Path)
+	if err == nil {
+		_, err = qm.frameOptions()
+	}
+	if err != nil {
+		log.DefaultLogger.Debug(fmt.Sprintf("SubscribeStream: %s", err.Error()))
+		return &backend.SubscribeStreamResponse{
+			Status: backend.SubscribeStreamStatusNotFound,
+		}, nil
+	}
+
 	return &backend.SubscribeStreamResponse{
 		Status: backend.SubscribeStreamStatusOK,
 	}, nil
 }
 
 func (ds *MQTTDatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
-	ds.Client.Subscribe(req.Path)
-	defer ds.Client.Unsubscribe(req.Path)
+	qm, err := parseStreamPath(req.Path)
+	if err != nil {
+		return err
+	}
+	opts, err := ds.frameOptions(qm)
+	if err != nil {
+		return err
+	}
+
+	if !ds.startStream() {
+		backend.Logger.Info("stop streaming (datasource disposed)")
+		return nil
+	}
+	defer ds.streams.Done()
+
+	ds.Client.Subscribe(qm.Topic)
+	defer ds.Client.Unsubscribe(qm.Topic)
+
+	sub := ds.Client.AddSubscriber(qm.Topic)
+	defer ds.Client.RemoveSubscriber(sub)
+
+	stream := newLiveStream(qm, opts, sender)
+	if opts.SinceLastUplink {
+		if messages, ok := ds.Client.Messages(qm.Topic); ok {
+			stream.seed(messages)
+		}
+	}
+
+	var heartbeat <-chan time.Time
+	if interval := qm.heartbeat(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
+			if dropped := sub.Dropped(); dropped > 0 {
+				log.DefaultLogger.Warn(fmt.Sprintf("stream for topic %s dropped %d messages", qm.Topic, dropped))
+			}
 			backend.Logger.Info("stop streaming (context canceled)")
 			return nil
-		case message := <-ds.Client.Stream():
-			if message.Topic != req.Path {
-				continue
+		case <-ds.done:
+			backend.Logger.Info("stop streaming (datasource disposed)")
+			return nil
+		case message, ok := <-sub.Messages():
+			if !ok {
+				return nil
 			}
-			err := ds.SendMessage(message, req, sender)
+			err := ds.SendMessage(message, stream)
 			if err != nil {
 				log.DefaultLogger.Error(fmt.Sprintf("unable to send message: %s", err.Error()))
 			}
+		case now := <-heartbeat:
+			if err := stream.heartbeat(now); err != nil {
+				log.DefaultLogger.Error(fmt.Sprintf("unable to send heartbeat: %s", err.Error()))
+			}
 		}
 	}
 }
 
-func (ds *MQTTDatasource) PublishStream(_ context.Context, _ *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+// PublishStream queues a LoRaWAN downlink published to the downlink path.
+// Downlinks must be enabled in the datasource settings and the user needs
+// the configured role.
+func (ds *MQTTDatasource) PublishStream(_ context.Context, req *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	if req.Path != downlinkPath {
+		return &backend.PublishStreamResponse{
+			Status: backend.PublishStreamStatusPermissionDenied,
+		}, nil
+	}
+
+	if !ds.Settings.EnableDownlinks || !hasRole(req.PluginContext.User, ds.Settings.DownlinkRole) {
+		return &backend.PublishStreamResponse{
+			Status: backend.PublishStreamStatusPermissionDenied,
+		}, nil
+	}
+
+	topic, message, correlationID, err := encodeDownlink(req.Data, ds.Settings.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the downlink events for the grace period, so the status of
+	// the downlink can be queried even if no status panel is open.
+	ds.Client.Subscribe(mqtt.DownlinksTopic)
+	defer ds.Client.Unsubscribe(mqtt.DownlinksTopic)
+
+	log.DefaultLogger.Info(fmt.Sprintf("Publishing downlink %s to %s", correlationID, topic))
+	if err := ds.Client.Publish(topic, message); err != nil {
+		return nil, err
+	}
+
 	return &backend.PublishStreamResponse{
-		Status: backend.PublishStreamStatusPermissionDenied,
+		Status: backend.PublishStreamStatusOK,
 	}, nil
 }
 
+// Query types, set by the query editor in DataQuery.QueryType.
+const (
+	// queryTypeDownlinks returns the status of the downlinks.
+	queryTypeDownlinks = "downlinks"
+	// queryTypeVariable returns the values of a template variable query.
+	queryTypeVariable = "variable"
+	// queryTypeJoins returns the join-accepts of the devices.
+	queryTypeJoins = "joins"
+	// queryTypeActivity returns the activity of each device.
+	queryTypeActivity = "activity"
+	// queryTypePacketLoss returns the frame counter analysis of each device.
+	queryTypePacketLoss = "packetLoss"
+	// queryTypeLocations returns the location of each device, for the Geomap panel.
+	queryTypeLocations = "locations"
+)
+
 type queryModel struct {
-	Topic string `json:"queryText"`
+	// Topic to query. For variable queries, the variable query, e.g. devices().
+	Topic  string      `json:"queryText"`
+	Layout FrameLayout `json:"layout,omitempty"`
+	// Fields to include, with optional aliases and units. All fields if empty.
+	Fields []FieldSelection `json:"fields,omitempty"`
+	// Fields computed from the decoded fields, e.g. temperature = t / 100.
+	Computed []ComputedField `json:"computed,omitempty"`
+	// Filter expression on the decoded records, e.g. battery < 3.3.
+	Filter string `json:"filter,omitempty"`
+	// Downsampling of the records into buckets of the query interval.
+	// Streams send every message, so they are not aggregated.
+	Aggregation *Aggregation `json:"aggregation,omitempty"`
+	// For location queries, also return the locations of the gateways.
+	Gateways bool `json:"gateways,omitempty"`
+	// Add the seconds since the last uplink of each device. Streams send it
+	// every Heartbeat seconds, even if no message arrives.
+	SinceLastUplink bool `json:"sinceLastUplink,omitempty"`
+	Heartbeat       int  `json:"heartbeat,omitempty"`
+	// For alert rules, the maximum age in seconds of the last value of a device
+	// that didn't send in the time range. Older devices have no data.
+	StaleAfter int `json:"staleAfter,omitempty"`
+}
+
+// frameOptions returns the options for ToFrames. Fails if an expression is invalid.
+func (qm queryModel) frameOptions() (FrameOptions, error) {
+	computed, err := CompileComputedFields(qm.Computed)
+	if err != nil {
+		return FrameOptions{}, err
+	}
+	filter, err := ParseFilter(qm.Filter)
+	if err != nil {
+		return FrameOptions{}, err
+	}
+	if err := qm.Aggregation.validate(); err != nil {
+		return FrameOptions{}, err
+	}
+	return FrameOptions{
+		Layout:          qm.Layout,
+		Fields:          qm.Fields,
+		Computed:        computed,
+		Filter:          filter,
+		Aggregation:     qm.Aggregation,
+		SinceLastUplink: qm.SinceLastUplink,
+	}, nil
+}
+
+// heartbeat returns the interval of the heartbeat frames of the stream, or 0 if disabled.
+func (qm queryModel) heartbeat() time.Duration {
+	if !qm.SinceLastUplink {
+		return 0
+	}
+	if qm.Heartbeat > 0 {
+		return time.Duration(qm.Heartbeat) * time.Second
+	}
+	return defaultHeartbeat
+}
+
+// staleAfter returns the maximum age of the last value kept by an alert rule.
+func (qm queryModel) staleAfter() time.Duration {
+	if qm.StaleAfter > 0 {
+		return time.Duration(qm.StaleAfter) * time.Second
+	}
+	return defaultStaleAfter
+}
+
+// frameOptions returns the options of the query for ToFrames, with the
+// decoders and device profiles of the datasource.
+func (ds *MQTTDatasource) frameOptions(qm queryModel) (FrameOptions, error) {
+	opts, err := qm.frameOptions()
+	if err != nil {
+		return opts, err
+	}
+	opts.Decoders = ds.Settings.Decoders
+	opts.Profiles = ds.Settings.Profiles
+	return opts, nil
+}
+
+// streamPath returns the Grafana Live path for the query. RunStream only
+// receives the path, so any query options are appended to the topic as a
+// base64 encoded segment.
+func streamPath(qm queryModel) string {
+	options, err := json.Marshal(qm)
+	if err != nil {
+		return qm.Topic
+	}
+	defaults, _ := json.Marshal(queryModel{Topic: qm.Topic})
+	if bytes.Equal(options, defaults) {
+		return qm.Topic
+	}
+	return qm.Topic + "/" + base64.RawURLEncoding.EncodeToString(options)
+}
+
+// parseStreamPath returns the query encoded in a path created by streamPath.
+// Topics contain "/", but the options don't, so they follow the last "/". Paths
+// whose last segment isn't an encoded JSON object are topics without options.
+func parseStreamPath(path string) (queryModel, error) {
+	idx := strings.LastIndex(path, "/")
+	if idx < 0 {
+		return queryModel{Topic: path}, nil
+	}
+
+	var qm queryModel
+	options, err := base64.RawURLEncoding.DecodeString(path[idx+1:])
+	if err != nil || !bytes.HasPrefix(options, []byte("{")) {
+		return queryModel{Topic: path}, nil
+	}
+	if err := json.Unmarshal(options, &qm); err != nil {
+		return qm, fmt.Errorf("invalid stream path %s: %w", path, err)
+	}
+	qm.Topic = path[:idx]
+	return qm, nil
 }
 
 func (ds *MQTTDatasource) Query(query backend.DataQuery) backend.DataResponse {
+	return ds.query(query, false)
+}
+
+// query returns the frames of the query. The uplinks of alert rule evaluations
+// are returned as numeric time series in the time range, see alertFrames.
+func (ds *MQTTDatasource) query(query backend.DataQuery, alerting bool) backend.DataResponse {
 	var qm queryModel
 
 	response := backend.DataResponse{}
@@ -154,28 +514,193 @@ func (ds *MQTTDatasource) Query(query backend.DataQuery) backend.DataResponse {
 		return response
 	}
 
-	// ensure the client is subscribed to the topic.
+	opts, err := ds.frameOptions(qm)
+	if err != nil {
+		response.Error = err
+		return response
+	}
+	opts.Interval = bucketInterval(query)
+	opts.Now = time.Now()
+	if !query.TimeRange.To.IsZero() && query.TimeRange.To.Before(opts.Now) {
+		opts.Now = query.TimeRange.To
+	}
+
+	switch query.QueryType {
+	case queryTypeDownlinks:
+		return ds.queryDownlinks()
+	case queryTypeVariable:
+		return ds.queryVariable(qm.Topic)
+	case queryTypeJoins:
+		return ds.queryJoins(query.TimeRange)
+	case queryTypeActivity:
+		return ds.queryActivity(query.TimeRange)
+	case queryTypePacketLoss:
+		return ds.queryPacketLoss(query.TimeRange)
+	case queryTypeLocations:
+		return ds.queryLocations(qm, query.TimeRange)
+	}
+
+	// ensure the client is subscribed to the topic. The subscription is
+	// kept for the grace period, so the history builds up between refreshes.
 	ds.Client.Subscribe(qm.Topic)
+	defer ds.Client.Unsubscribe(qm.Topic)
 
 	messages, ok := ds.Client.Messages(qm.Topic)
 	if !ok {
 		return response
 	}
 
-	frame := ToFrame(qm.Topic, messages)
+	if alerting {
+		response.Frames = ds.queryAlert(qm.Topic, messages, opts, query.TimeRange, qm.staleAfter())
+		return response
+	}
+
+	frames := ToFrames(qm.Topic, messages, opts)
 
-	if qm.Topic != "" {
-		frame.SetMeta(&data.FrameMeta{
-			Channel: ds.channelPrefix + qm.Topic,
+	// only the first frame carries the channel, otherwise the
+	// panel would open one stream per frame.
+	if qm.Topic != "" && len(frames) > 0 {
+		frames[0].SetMeta(&data.FrameMeta{
+			Channel: ds.channelPrefix + streamPath(qm),
 		})
 	}
 
-	response.Frames = append(response.Frames, frame)
+	response.Frames = append(response.Frames, frames...)
+	return response
+}
+
+// queryAlert returns the decoded uplinks as numeric time series for an alert rule.
+func (ds *MQTTDatasource) queryAlert(topic string, messages []mqtt.Message, opts FrameOptions, tr backend.TimeRange, staleAfter time.Duration) data.Frames {
+	records, notices, err := decodeMessagesWithNotices(messages, opts.Decoders)
+	if err != nil {
+		return data.Frames{decode_error_frame(topic, err, notices)}
+	}
+	frames := alertFrames(topic, apply_options(records, opts), tr, staleAfter, opts)
+	set_notices(frames[0], notices)
+	return frames
+}
+
+// queryDownlinks returns the lifecycle of the downlinks seen on the broker.
+func (ds *MQTTDatasource) queryDownlinks() backend.DataResponse {
+	response := backend.DataResponse{}
+
+	ds.Client.Subscribe(mqtt.DownlinksTopic)
+	defer ds.Client.Unsubscribe(mqtt.DownlinksTopic)
+
+	messages, ok := ds.Client.Messages(mqtt.DownlinksTopic)
+	if !ok {
+		return response
+	}
+
+	response.Frames = append(response.Frames, downlinkStatusFrame(mqtt.DownlinksTopic, messages))
+	return response
+}
+
+// queryJoins returns the join-accepts in the time range.
+func (ds *MQTTDatasource) queryJoins(tr backend.TimeRange) backend.DataResponse {
+	response := backend.DataResponse{}
+
+	ds.Client.Subscribe(mqtt.JoinsTopic)
+	defer ds.Client.Unsubscribe(mqtt.JoinsTopic)
+
+	messages, ok := ds.Client.Messages(mqtt.JoinsTopic)
+	if !ok {
+		return response
+	}
+
+	response.Frames = append(response.Frames, joinFrame(mqtt.JoinsTopic, messages, tr))
+	return response
+}
+
+// queryActivity returns the activity of each device in the buffered uplinks and joins.
+func (ds *MQTTDatasource) queryActivity(tr backend.TimeRange) backend.DataResponse {
+	response := backend.DataResponse{}
+
+	ds.Client.Subscribe(mqtt.DefaultTopic)
+	defer ds.Client.Unsubscribe(mqtt.DefaultTopic)
+	ds.Client.Subscribe(mqtt.JoinsTopic)
+	defer ds.Client.Unsubscribe(mqtt.JoinsTopic)
+
+	uplinks, _ := ds.Client.Messages(mqtt.DefaultTopic)
+	joins, _ := ds.Client.Messages(mqtt.JoinsTopic)
+
+	response.Frames = append(response.Frames, deviceActivityFrame("activity", uplinks, joins, tr, time.Now()))
+	return response
+}
+
+// queryPacketLoss returns the missed, duplicated and reset frame counters of
+// each device in the time range.
+func (ds *MQTTDatasource) queryPacketLoss(tr backend.TimeRange) backend.DataResponse {
+	response := backend.DataResponse{}
+
+	ds.Client.Subscribe(mqtt.DefaultTopic)
+	defer ds.Client.Unsubscribe(mqtt.DefaultTopic)
+
+	messages, ok := ds.Client.Messages(mqtt.DefaultTopic)
+	if !ok {
+		return response
+	}
+
+	duplicates := ds.Client.Duplicates(mqtt.DefaultTopic)
+	response.Frames = append(response.Frames, packetLossFrame("packetLoss", messages, duplicates, tr))
+	return response
+}
+
+// queryLocations returns the last location of each device in the time range,
+// and of each gateway if requested, from the uplinks and the solved locations.
+func (ds *MQTTDatasource) queryLocations(qm queryModel, tr backend.TimeRange) backend.DataResponse {
+	response := backend.DataResponse{}
+
+	ds.Client.Subscribe(mqtt.DefaultTopic)
+	defer ds.Client.Unsubscribe(mqtt.DefaultTopic)
+	ds.Client.Subscribe(mqtt.LocationsTopic)
+	defer ds.Client.Unsubscribe(mqtt.LocationsTopic)
+
+	var records []record
+	if messages, ok := ds.Client.Messages(mqtt.DefaultTopic); ok && len(messages) > 0 {
+		var err error
+		records, err = decodeMessages(messages, ds.Settings.Decoders)
+		if err != nil {
+			log.DefaultLogger.Debug(fmt.Sprintf("queryLocations: %s", err.Error()))
+		}
+	}
+	solved, _ := ds.Client.Messages(mqtt.LocationsTopic)
+
+	response.Frames = append(response.Frames, locationFrame("devices", "device_id", "dev_eui", deviceLocations(records, solved, tr)))
+	if qm.Gateways {
+		response.Frames = append(response.Frames, locationFrame("gateways", "gateway_id", "eui", gatewayLocations(records, tr)))
+	}
 	return response
 }
 
-func (ds *MQTTDatasource) SendMessage(msg mqtt.StreamMessage, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
-	if !ds.Client.IsSubscribed(req.Path) {
+// queryVariable returns the values of a template variable query, e.g. devices(),
+// from the buffered uplinks.
+func (ds *MQTTDatasource) queryVariable(text string) backend.DataResponse {
+	response := backend.DataResponse{}
+
+	q, err := parseVariableQuery(text)
+	if err != nil {
+		response.Error = err
+		return response
+	}
+
+	ds.Client.Subscribe(mqtt.DefaultTopic)
+	defer ds.Client.Unsubscribe(mqtt.DefaultTopic)
+
+	var records []record
+	if messages, ok := ds.Client.Messages(mqtt.DefaultTopic); ok && len(messages) > 0 {
+		records, err = decodeMessages(messages, ds.Settings.Decoders)
+		if err != nil {
+			log.DefaultLogger.Debug(fmt.Sprintf("queryVariable: %s", err.Error()))
+		}
+	}
+
+	response.Frames = append(response.Frames, variableFrame(q, records))
+	return response
+}
+
+func (ds *MQTTDatasource) SendMessage(msg mqtt.StreamMessage, stream *liveStream) error {
+	if !ds.Client.IsSubscribed(stream.query.Topic) {
 		return nil
 	}
 
@@ -184,8 +709,33 @@ func (ds *MQTTDatasource) SendMessage(msg mqtt.StreamMessage, req *backend.RunSt
 		Value:     msg.Value,
 	}
 
-	frame := ToFrame(msg.Topic, []mqtt.Message{message})
+	frames := ToFrames(msg.Topic, []mqtt.Message{message}, stream.options)
 
 	log.DefaultLogger.Debug(fmt.Sprintf("Sending message to client for topic %s", msg.Topic))
-	return sender.SendFrame(frame, data.IncludeAll)
+	sent := false
+	for _, frame := range frames {
+		// notices of a single message, e.g. payload formatter errors, are only logged
+		if frame.Meta != nil {
+			for _, notice := range frame.Meta.Notices {
+				log.DefaultLogger.Warn(fmt.Sprintf("stream for topic %s: %s", msg.Topic, notice.Text))
+			}
+		}
+		// the message didn't decode or match the filter
+		if frame.Rows() == 0 {
+			continue
+		}
+		if err := stream.send(frame); err != nil {
+			return err
+		}
+		sent = true
+	}
+
+	// remember the device for the heartbeats
+	if sent && stream.options.SinceLastUplink {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(msg.Value), &doc); err == nil {
+			stream.seen(device_labels(doc), message.Timestamp)
+		}
+	}
+	return nil
 }
@@ -1,10 +1,18 @@
 package plugin_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/mqtt-datasource/pkg/mqtt"
 	"github.com/grafana/mqtt-datasource/pkg/plugin"
 	"github.com/stretchr/testify/require"
@@ -40,29 +48,495 @@ func TestCheckHealthHandler(t *testing.T) {
 		require.Equal(t, res.Status, backend.HealthStatusError)
 		require.Equal(t, res.Message, "MQTT Disconnected")
 	})
+
+	t.Run("details of the connection", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			health: &mqtt.Health{
+				Broker:           "tcp://au1.cloud.thethings.network:1883",
+				Connected:        true,
+				State:            mqtt.StateConnected,
+				ConnectLatencyMs: 42,
+				Authentication:   mqtt.AuthenticationOK,
+				Subscription:     mqtt.SubscriptionCheck{Topic: "v3/luppy-application@ttn/devices/+/up", Granted: true},
+				Traffic:          mqtt.Traffic{Minutes: 5, Received: 10, Rejected: 2},
+			},
+		}, "xyz")
+
+		res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.JSONEq(t, `{
+			"broker": "tcp://au1.cloud.thethings.network:1883",
+			"connected": true,
+			"state": "connected",
+			"connectLatencyMs": 42,
+			"authentication": "ok",
+			"subscription": {"topic": "v3/luppy-application@ttn/devices/+/up", "granted": true},
+			"traffic": {"minutes": 5, "received": 10, "rejected": 2}
+		}`, string(res.JSONDetails))
+	})
+
+	t.Run("HealthStatusError when authentication fails", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			health: &mqtt.Health{Authentication: mqtt.AuthenticationFailed, Error: "bad user name or password"},
+		}, "xyz")
+
+		res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.Equal(t, "MQTT Disconnected: authentication failed", res.Message)
+	})
+
+	t.Run("HealthStatusError while connecting", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			health: &mqtt.Health{State: mqtt.StateConnecting, Authentication: mqtt.AuthenticationUnknown, Error: "dial tcp: connection refused"},
+		}, "xyz")
+
+		res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.Equal(t, "MQTT Connecting: dial tcp: connection refused", res.Message)
+	})
+
+	t.Run("HealthStatusError when the subscription is refused", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			health: &mqtt.Health{
+				Connected:    true,
+				Subscription: mqtt.SubscriptionCheck{Topic: "v3/app@ttn/devices/+/up", Error: "subscription refused by the broker"},
+			},
+		}, "xyz")
+
+		res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.Equal(t, "MQTT Connected, but subscribing to v3/app@ttn/devices/+/up failed: subscription refused by the broker", res.Message)
+	})
+}
+
+func TestQueryWithoutGracePeriod(t *testing.T) {
+	// the broker is unreachable, the messages are handed to the client directly
+	instance, err := plugin.NewMQTTInstance(backend.DataSourceInstanceSettings{
+		UID:      "xyz",
+		JSONData: []byte(`{"host": "127.0.0.1", "port": 1, "gracePeriod": 0, "deduplicationWindow": 0}`),
+	})
+	require.NoError(t, err)
+	ds := instance.(*plugin.MQTTDatasource)
+	defer ds.Dispose()
+	client := ds.Client.(*mqtt.Client)
+
+	query := backend.DataQuery{JSON: []byte(`{"queryText": "all"}`)}
+	client.HandleMessage(nil, &uplinkMessage{device: "tank-1", payload: uplink(t, "tank-1", map[string]interface{}{"t": 1234})})
+	res := ds.Query(query)
+	require.NoError(t, res.Error)
+	require.Equal(t, 1, res.Frames[0].Rows())
+
+	// the history is kept between queries
+	client.HandleMessage(nil, &uplinkMessage{device: "tank-1", payload: uplink(t, "tank-1", map[string]interface{}{"t": 2345})})
+	res = ds.Query(query)
+	require.NoError(t, res.Error)
+	require.Equal(t, 2, res.Frames[0].Rows())
+}
+
+// uplinkMessage is an uplink received from the broker.
+type uplinkMessage struct {
+	device  string
+	payload string
+}
+
+func (m *uplinkMessage) Duplicate() bool   { return false }
+func (m *uplinkMessage) Qos() byte         { return 0 }
+func (m *uplinkMessage) Retained() bool    { return false }
+func (m *uplinkMessage) Topic() string     { return "v3/app@ttn/devices/" + m.device + "/up" }
+func (m *uplinkMessage) MessageID() uint16 { return 0 }
+func (m *uplinkMessage) Ack()              {}
+
+func (m *uplinkMessage) Payload() []byte {
+	// the broker sends compact JSON
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, []byte(m.payload)); err != nil {
+		panic(err)
+	}
+	return payload.Bytes()
+}
+
+func TestQueryDataWhileConnecting(t *testing.T) {
+	client := &fakeMQTTClient{
+		connecting: errors.New("dial tcp: connection refused"),
+		messages:   map[string][]mqtt.Message{},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"queryText": "all"}`)}},
+	})
+	require.NoError(t, err)
+	frames := res.Responses["A"].Frames
+	require.Len(t, frames, 1)
+	require.Equal(t, "ds/xyz/all", frames[0].Meta.Channel)
+	require.Equal(t, []data.Notice{{
+		Severity: data.NoticeSeverityWarning,
+		Text:     "MQTT connecting, uplinks received meanwhile are missing: dial tcp: connection refused",
+	}}, frames[0].Meta.Notices)
+
+}
+
+func TestDispose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	client := &fakeMQTTClient{
+		connected:  true,
+		subscribed: true,
+		streams:    mqtt.NewSubscribers(10),
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+	sender := &fakePacketSender{packets: make(chan *backend.StreamPacket, 10)}
+
+	// the streams run until the instance is disposed, their context is never canceled
+	done := make(chan error)
+	for idx := 0; idx < 2; idx++ {
+		go func() {
+			done <- ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: "all"}, backend.NewStreamSender(sender))
+		}()
+	}
+	require.Eventually(t, func() bool { return client.streams.Count("all") == 2 }, time.Second, time.Millisecond)
+
+	ds.Dispose()
+	require.NoError(t, <-done)
+	require.NoError(t, <-done)
+	require.True(t, client.disposed)
+	require.Equal(t, 0, client.streams.Count("all"))
+
+	// streams started after Dispose return at once
+	require.NoError(t, ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: "all"}, backend.NewStreamSender(sender)))
+	ds.Dispose()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines remain, expected %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunStream(t *testing.T) {
+	t.Run("schema is only sent when it changes", func(t *testing.T) {
+		client := &fakeMQTTClient{
+			connected:  true,
+			subscribed: true,
+			streams:    mqtt.NewSubscribers(10),
+		}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+		sender := &fakePacketSender{packets: make(chan *backend.StreamPacket, 10)}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: "all"}, backend.NewStreamSender(sender))
+		}()
+
+		require.Eventually(t, func() bool { return client.streams.Count("all") == 1 }, time.Second, time.Millisecond)
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})})
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 2345})})
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-2", map[string]interface{}{"t": 3456})})
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"l": 1000})})
+
+		require.True(t, hasSchema(t, sender.next(t)))
+		require.False(t, hasSchema(t, sender.next(t)))
+		require.True(t, hasSchema(t, sender.next(t)))
+		schema := sender.next(t)
+		require.True(t, hasSchema(t, schema))
+
+		var frame struct {
+			Schema struct {
+				Fields []struct {
+					Name string `json:"name"`
+				} `json:"fields"`
+			} `json:"schema"`
+		}
+		require.NoError(t, json.Unmarshal(schema.Data, &frame))
+		require.Len(t, frame.Schema.Fields, 4)
+
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	t.Run("stream path of a TTN topic", func(t *testing.T) {
+		const topic = "v3/luppy-application@ttn/devices/tank-1/up"
+		client := &fakeMQTTClient{
+			connected:  true,
+			subscribed: true,
+			streams:    mqtt.NewSubscribers(10),
+			messages:   map[string][]mqtt.Message{},
+		}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+		sender := &fakePacketSender{packets: make(chan *backend.StreamPacket, 10)}
+
+		for _, query := range []string{
+			`{"queryText": "` + topic + `"}`,
+			`{"queryText": "` + topic + `", "fields": [{"name": "t", "alias": "temperature"}]}`,
+		} {
+			res := ds.Query(backend.DataQuery{JSON: []byte(query)})
+			require.NoError(t, res.Error)
+			path := strings.TrimPrefix(res.Frames[0].Meta.Channel, "ds/xyz/")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() {
+				done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(sender))
+			}()
+			require.Eventually(t, func() bool { return client.streams.Count(topic) == 1 }, time.Second, time.Millisecond, query)
+			client.streams.Publish(mqtt.StreamMessage{Topic: topic, Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234, "l": 5})})
+
+			var frame struct {
+				Schema struct {
+					Fields []struct {
+						Name string `json:"name"`
+					} `json:"fields"`
+				} `json:"schema"`
+			}
+			require.NoError(t, json.Unmarshal(sender.next(t).Data, &frame))
+			names := make([]string, 0, len(frame.Schema.Fields))
+			for _, field := range frame.Schema.Fields {
+				names = append(names, field.Name)
+			}
+			if strings.Contains(query, "fields") {
+				require.Equal(t, []string{"Time", "temperature"}, names)
+			} else {
+				require.Contains(t, names, "l")
+			}
+
+			cancel()
+			require.NoError(t, <-done)
+		}
+	})
+
+	t.Run("numbers of both signs are streamed", func(t *testing.T) {
+		client := &fakeMQTTClient{
+			connected:  true,
+			subscribed: true,
+			streams:    mqtt.NewSubscribers(10),
+		}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+		sender := &fakePacketSender{packets: make(chan *backend.StreamPacket, 10)}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: "all"}, backend.NewStreamSender(sender))
+		}()
+
+		require.Eventually(t, func() bool { return client.streams.Count("all") == 1 }, time.Second, time.Millisecond)
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 5})})
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": -3})})
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 2.5})})
+
+		for _, expected := range []float64{5, -3, 2.5} {
+			var frame struct {
+				Data struct {
+					Values [][]interface{} `json:"values"`
+				} `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(sender.next(t).Data, &frame))
+			require.Len(t, frame.Data.Values, 2)
+			require.Equal(t, expected, frame.Data.Values[1][0])
+		}
+
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	t.Run("every stream receives every message", func(t *testing.T) {
+		client := &fakeMQTTClient{
+			connected:  true,
+			subscribed: true,
+			streams:    mqtt.NewSubscribers(10),
+		}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		senders := []*fakePacketSender{
+			{packets: make(chan *backend.StreamPacket, 10)},
+			{packets: make(chan *backend.StreamPacket, 10)},
+		}
+		done := make(chan error)
+		for _, sender := range senders {
+			go func(sender *fakePacketSender) {
+				done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: "all"}, backend.NewStreamSender(sender))
+			}(sender)
+		}
+
+		require.Eventually(t, func() bool { return client.streams.Count("all") == 2 }, time.Second, time.Millisecond)
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})})
+		client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 2345})})
+
+		for _, sender := range senders {
+			require.True(t, hasSchema(t, sender.next(t)))
+			require.False(t, hasSchema(t, sender.next(t)))
+		}
+
+		cancel()
+		require.NoError(t, <-done)
+		require.NoError(t, <-done)
+		require.Equal(t, 0, client.streams.Count("all"))
+	})
+}
+
+type fakePacketSender struct {
+	packets chan *backend.StreamPacket
+}
+
+func (s *fakePacketSender) Send(packet *backend.StreamPacket) error {
+	s.packets <- packet
+	return nil
+}
+
+func (s *fakePacketSender) next(t *testing.T) *backend.StreamPacket {
+	select {
+	case packet := <-s.packets:
+		return packet
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for stream packet")
+		return nil
+	}
+}
+
+func hasSchema(t *testing.T, packet *backend.StreamPacket) bool {
+	var frame map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(packet.Data, &frame))
+	_, ok := frame["schema"]
+	return ok
 }
 
 type fakeMQTTClient struct {
 	connected  bool
+	connecting error
 	subscribed bool
+	streams    *mqtt.Subscribers
+	published  map[string][]byte
+	messages   map[string][]mqtt.Message
+	duplicates map[string][]mqtt.Message
+	observed   []mqtt.ObservedTopic
+	health     *mqtt.Health
+	disposed   bool
 }
 
 func (c *fakeMQTTClient) IsConnected() bool {
 	return c.connected
 }
 
+func (c *fakeMQTTClient) State() (string, error) {
+	switch {
+	case c.connected:
+		return mqtt.StateConnected, nil
+	case c.connecting != nil:
+		return mqtt.StateConnecting, c.connecting
+	default:
+		return mqtt.StateDisconnected, nil
+	}
+}
+
 func (c *fakeMQTTClient) IsSubscribed(_ string) bool {
 	return c.subscribed
 }
 
-func (c *fakeMQTTClient) Messages(_ string) ([]mqtt.Message, bool) {
-	return []mqtt.Message{}, true
+func (c *fakeMQTTClient) Messages(topic string) ([]mqtt.Message, bool) {
+	return c.messages[topic], true
+}
+
+func (c *fakeMQTTClient) Duplicates(topic string) []mqtt.Message {
+	return c.duplicates[topic]
 }
 
-func (c *fakeMQTTClient) Stream() chan mqtt.StreamMessage {
-	return make(chan mqtt.StreamMessage)
+func (c *fakeMQTTClient) AddSubscriber(topic string) *mqtt.Subscriber {
+	return c.streams.Add(topic)
+}
+
+func (c *fakeMQTTClient) RemoveSubscriber(sub *mqtt.Subscriber) {
+	c.streams.Remove(sub)
 }
 
 func (c *fakeMQTTClient) Subscribe(_ string) {}
 
 func (c *fakeMQTTClient) Unsubscribe(_ string) {}
+
+func (c *fakeMQTTClient) ObservedTopics() []mqtt.ObservedTopic {
+	return c.observed
+}
+
+func (c *fakeMQTTClient) Health() mqtt.Health {
+	if c.health != nil {
+		return *c.health
+	}
+	state, _ := c.State()
+	return mqtt.Health{
+		Connected:    c.connected,
+		State:        state,
+		Subscription: mqtt.SubscriptionCheck{Granted: c.connected},
+	}
+}
+
+func (c *fakeMQTTClient) Dispose() {
+	c.disposed = true
+}
+
+func (c *fakeMQTTClient) Publish(topic string, payload []byte) error {
+	if c.published == nil {
+		c.published = make(map[string][]byte)
+	}
+	c.published[topic] = payload
+	return nil
+}
+
+func TestVariableQuery(t *testing.T) {
+	client := &fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"all": {
+				{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-2", map[string]interface{}{"l": 1000})},
+				{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})},
+				{Timestamp: time.Unix(3, 0), Value: `{
+					"end_device_ids": {"device_id": "tank-1"},
+					"uplink_message": {
+						"frm_payload": "oWF0GQTS",
+						"rx_metadata": [
+							{"gateway_ids": {"gateway_id": "luppy-wisgate-rak7248"}},
+							{"gateway_ids": {"gateway_id": "other-gateway"}}
+						]
+					}
+				}`},
+			},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	values := func(t *testing.T, text string) []string {
+		res := ds.Query(backend.DataQuery{
+			QueryType: "variable",
+			JSON:      []byte(fmt.Sprintf(`{"queryText": %q}`, text)),
+		})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		require.Len(t, res.Frames[0].Fields, 1)
+		field := res.Frames[0].Fields[0]
+		values := make([]string, field.Len())
+		for idx := range values {
+			values[idx] = field.At(idx).(string)
+		}
+		return values
+	}
+
+	require.Equal(t, []string{"tank-1", "tank-2"}, values(t, "devices()"))
+	require.Equal(t, []string{"l", "t"}, values(t, "fields()"))
+	require.Equal(t, []string{"t"}, values(t, `fields("tank-1")`))
+	require.Equal(t, []string{"l"}, values(t, "fields(tank-2)"))
+	require.Equal(t, []string{"luppy-wisgate-rak7248", "other-gateway"}, values(t, "gateways()"))
+
+	for _, text := range []string{"", "devices", "sensors()", "devices(tank-1)"} {
+		res := ds.Query(backend.DataQuery{
+			QueryType: "variable",
+			JSON:      []byte(fmt.Sprintf(`{"queryText": %q}`, text)),
+		})
+		require.Error(t, res.Error, text)
+	}
+}
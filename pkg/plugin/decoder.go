@@ -0,0 +1,357 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload decoders that can be selected by a DecoderRule.
+const (
+	// DecoderCBOR decodes the frm_payload as a CBOR map (default).
+	DecoderCBOR = "cbor"
+	// DecoderLPP decodes the frm_payload as Cayenne Low Power Payload.
+	DecoderLPP = "lpp"
+	// DecoderStruct decodes the frm_payload with a fixed binary layout.
+	DecoderStruct = "struct"
+	// DecoderDecodedPayload uses the decoded_payload of the payload formatter at The Things Network.
+	DecoderDecodedPayload = "decoded_payload"
+)
+
+// DecoderRule selects the decoder for the uplinks that match all of its conditions.
+// A rule without conditions matches every uplink.
+type DecoderRule struct {
+	// FPort of the uplink.
+	FPort *uint64 `json:"fPort,omitempty"`
+	// Regular expression matching the whole device ID.
+	DeviceID string `json:"deviceId,omitempty"`
+	// Inclusive range of DevEUIs, as hex strings.
+	DevEUIFrom string `json:"devEuiFrom,omitempty"`
+	DevEUITo   string `json:"devEuiTo,omitempty"`
+
+	// Decoder for the payload: cbor, lpp, struct, decoded_payload or javascript.
+	Decoder string `json:"decoder"`
+	// Layout of the payload for the struct decoder.
+	Layout []StructField `json:"layout,omitempty"`
+	// Byte order of the struct layout: big (default) or little.
+	ByteOrder string `json:"byteOrder,omitempty"`
+	// Payload formatter for the javascript decoder, defining decodeUplink(input).
+	Script string `json:"script,omitempty"`
+	// Timeout of the payload formatter for each uplink, in milliseconds. Defaults to 100.
+	Timeout int `json:"timeout,omitempty"`
+
+	javaScript *javaScriptDecoder
+	runtime    *javaScriptRuntime
+	deviceID   *regexp.Regexp
+	devEUIFrom *uint64
+	devEUITo   *uint64
+	byteOrder  binary.ByteOrder
+}
+
+// StructField is a field of a binary payload layout, read in order.
+type StructField struct {
+	Name string `json:"name"`
+	// Type: uint8, int8, uint16, int16, uint32, int32, uint64, int64, float32 or float64.
+	Type string `json:"type"`
+	// Scale multiplies the value, e.g. 0.01 for centidegrees. The value is a float if set.
+	Scale float64 `json:"scale,omitempty"`
+}
+
+// structFieldSizes is the size in bytes of each struct field type.
+var structFieldSizes = map[string]int{
+	"uint8": 1, "int8": 1, "uint16": 2, "int16": 2, "uint32": 4, "int32": 4,
+	"uint64": 8, "int64": 8, "float32": 4, "float64": 8,
+}
+
+// UnmarshalJSON decodes the rule, validates the decoder and parses the conditions.
+func (d *DecoderRule) UnmarshalJSON(b []byte) error {
+	type rule DecoderRule
+	if err := json.Unmarshal(b, (*rule)(d)); err != nil {
+		return err
+	}
+
+	switch d.Decoder {
+	case DecoderCBOR, DecoderLPP, DecoderDecodedPayload:
+	case DecoderJavaScript:
+		decoder, err := newJavaScriptDecoder(d.Script, time.Duration(d.Timeout)*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		d.javaScript = decoder
+	case DecoderStruct:
+		if len(d.Layout) == 0 {
+			return errors.New("struct decoder without layout")
+		}
+		for _, field := range d.Layout {
+			if _, ok := structFieldSizes[field.Type]; !ok {
+				return fmt.Errorf("unknown type %s for struct field %s", field.Type, field.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown decoder: %q", d.Decoder)
+	}
+
+	switch d.ByteOrder {
+	case "", "big":
+		d.byteOrder = binary.BigEndian
+	case "little":
+		d.byteOrder = binary.LittleEndian
+	default:
+		return fmt.Errorf("unknown byte order: %s", d.ByteOrder)
+	}
+
+	d.deviceID = nil
+	if d.DeviceID != "" {
+		re, err := regexp.Compile("^(?:" + d.DeviceID + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid device ID pattern: %w", err)
+		}
+		d.deviceID = re
+	}
+
+	var err error
+	if d.devEUIFrom, err = parseEUI(d.DevEUIFrom); err != nil {
+		return err
+	}
+	if d.devEUITo, err = parseEUI(d.DevEUITo); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseEUI parses a 64-bit EUI in hex, optionally separated by colons or dashes.
+func parseEUI(eui string) (*uint64, error) {
+	if eui == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseUint(strings.NewReplacer(":", "", "-", "").Replace(eui), 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EUI %s: %w", eui, err)
+	}
+	return &value, nil
+}
+
+// matches returns true if the uplink with the port, device ID and DevEUI satisfies the rule.
+func (d *DecoderRule) matches(fPort uint64, deviceID, devEUI string) bool {
+	if d.FPort != nil && *d.FPort != fPort {
+		return false
+	}
+	if d.deviceID != nil && !d.deviceID.MatchString(deviceID) {
+		return false
+	}
+	if d.devEUIFrom != nil || d.devEUITo != nil {
+		eui, err := parseEUI(devEUI)
+		if err != nil || eui == nil {
+			return false
+		}
+		if d.devEUIFrom != nil && *eui < *d.devEUIFrom {
+			return false
+		}
+		if d.devEUITo != nil && *eui > *d.devEUITo {
+			return false
+		}
+	}
+	return true
+}
+
+// selectDecoder returns the first rule matching the uplink, or nil for the default CBOR decoder.
+func selectDecoder(rules []DecoderRule, fPort uint64, deviceID, devEUI string) *DecoderRule {
+	for idx := range rules {
+		if rules[idx].matches(fPort, deviceID, devEUI) {
+			return &rules[idx]
+		}
+	}
+	return nil
+}
+
+// decode returns the fields decoded from the uplink message by the rule's decoder, and
+// the warnings of the decoder. CBOR payloads are decoded by decodePayload.
+func (d *DecoderRule) decode(uplinkMessage map[string]interface{}, fPort uint64) (map[string]interface{}, []string, error) {
+	if d.Decoder == DecoderDecodedPayload {
+		body, ok := uplinkMessage["decoded_payload"].(map[string]interface{})
+		if !ok {
+			return nil, nil, errors.New("decoded_payload missing")
+		}
+		return body, nil, nil
+	}
+
+	frmPayload, ok := uplinkMessage["frm_payload"].(string)
+	if !ok {
+		return nil, nil, errors.New("frm_payload missing")
+	}
+	payload, err := base64.StdEncoding.DecodeString(frmPayload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch d.Decoder {
+	case DecoderLPP:
+		body, err := decodeLPP(payload)
+		return body, nil, err
+	case DecoderStruct:
+		order := d.byteOrder
+		if order == nil {
+			order = binary.BigEndian
+		}
+		body, err := decodeStruct(payload, d.Layout, order)
+		return body, nil, err
+	case DecoderJavaScript:
+		if d.javaScript == nil {
+			return nil, nil, errors.New("script not compiled")
+		}
+		recvTime := time.Now()
+		if receivedAt, ok := uplinkMessage["received_at"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, receivedAt); err == nil {
+				recvTime = t
+			}
+		}
+		return d.javaScript.decode(d.runtime, payload, fPort, recvTime)
+	}
+	return nil, nil, fmt.Errorf("unknown decoder: %q", d.Decoder)
+}
+
+// decodeStruct reads the fields of the layout from the payload, in order.
+// Unsigned integers decode to uint64 and signed integers to int64, like CBOR.
+func decodeStruct(payload []byte, layout []StructField, order binary.ByteOrder) (map[string]interface{}, error) {
+	body := make(map[string]interface{}, len(layout))
+	offset := 0
+	for _, field := range layout {
+		size := structFieldSizes[field.Type]
+		if offset+size > len(payload) {
+			return nil, fmt.Errorf("payload too short for struct field %s: %d bytes", field.Name, len(payload))
+		}
+		b := payload[offset : offset+size]
+		offset += size
+
+		var value interface{}
+		switch field.Type {
+		case "uint8":
+			value = uint64(b[0])
+		case "int8":
+			value = int64(int8(b[0]))
+		case "uint16":
+			value = uint64(order.Uint16(b))
+		case "int16":
+			value = int64(int16(order.Uint16(b)))
+		case "uint32":
+			value = uint64(order.Uint32(b))
+		case "int32":
+			value = int64(int32(order.Uint32(b)))
+		case "uint64":
+			value = order.Uint64(b)
+		case "int64":
+			value = int64(order.Uint64(b))
+		case "float32":
+			value = float64(math.Float32frombits(order.Uint32(b)))
+		case "float64":
+			value = math.Float64frombits(order.Uint64(b))
+		}
+
+		if field.Scale != 0 {
+			value = normalize(value).(float64) * field.Scale
+		}
+		if field.Name != "" {
+			body[field.Name] = value
+		}
+	}
+	return body, nil
+}
+
+// lppType describes a Cayenne LPP data type: the field name, the size and
+// signedness of each value, and the resolution.
+type lppType struct {
+	name       string
+	size       int
+	signed     bool
+	resolution float64
+	// names of the values for types with several values, e.g. x, y and z.
+	values []string
+}
+
+// lppTypes are the Cayenne LPP data types, named like the LPP formatter at The Things Network.
+var lppTypes = map[byte]lppType{
+	0:   {name: "digital_in", size: 1, resolution: 1},
+	1:   {name: "digital_out", size: 1, resolution: 1},
+	2:   {name: "analog_in", size: 2, signed: true, resolution: 0.01},
+	3:   {name: "analog_out", size: 2, signed: true, resolution: 0.01},
+	101: {name: "luminosity", size: 2, resolution: 1},
+	102: {name: "presence", size: 1, resolution: 1},
+	103: {name: "temperature", size: 2, signed: true, resolution: 0.1},
+	104: {name: "relative_humidity", size: 1, resolution: 0.5},
+	113: {name: "accelerometer", size: 2, signed: true, resolution: 0.001, values: []string{"x", "y", "z"}},
+	115: {name: "barometric_pressure", size: 2, resolution: 0.1},
+	116: {name: "voltage", size: 2, resolution: 0.01},
+	117: {name: "current", size: 2, resolution: 0.001},
+	120: {name: "percentage", size: 1, resolution: 1},
+	121: {name: "altitude", size: 2, signed: true, resolution: 1},
+	125: {name: "concentration", size: 2, resolution: 1},
+	128: {name: "power", size: 2, resolution: 1},
+	132: {name: "direction", size: 2, resolution: 1},
+	134: {name: "gyrometer", size: 2, signed: true, resolution: 0.01, values: []string{"x", "y", "z"}},
+	136: {name: "gps", size: 3, signed: true, values: []string{"latitude", "longitude", "altitude"}},
+	142: {name: "switch", size: 1, resolution: 1},
+}
+
+// GPS resolutions of latitude, longitude and altitude.
+var lppGPSResolutions = []float64{0.0001, 0.0001, 0.01}
+
+// decodeLPP decodes a Cayenne Low Power Payload: a sequence of channel, type and value.
+// Fields are named type_channel, e.g. temperature_1, or type_channel_value for types
+// with several values, e.g. accelerometer_3_x.
+func decodeLPP(payload []byte) (map[string]interface{}, error) {
+	body := make(map[string]interface{})
+	for offset := 0; offset < len(payload); {
+		if offset+2 > len(payload) {
+			return nil, fmt.Errorf("truncated LPP payload at %d", offset)
+		}
+		channel, code := payload[offset], payload[offset+1]
+		offset += 2
+
+		typ, ok := lppTypes[code]
+		if !ok {
+			return nil, fmt.Errorf("unknown LPP type %d at %d", code, offset-1)
+		}
+		count := len(typ.values)
+		if count == 0 {
+			count = 1
+		}
+		if offset+typ.size*count > len(payload) {
+			return nil, fmt.Errorf("truncated LPP %s at %d", typ.name, offset)
+		}
+
+		for idx := 0; idx < count; idx++ {
+			raw := readLPPValue(payload[offset:offset+typ.size], typ.signed)
+			offset += typ.size
+
+			resolution := typ.resolution
+			if typ.name == "gps" {
+				resolution = lppGPSResolutions[idx]
+			}
+			name := fmt.Sprintf("%s_%d", typ.name, channel)
+			if typ.values != nil {
+				name += "_" + typ.values[idx]
+			}
+			body[name] = float64(raw) * resolution
+		}
+	}
+	return body, nil
+}
+
+// readLPPValue reads a big endian integer of 1 to 4 bytes.
+func readLPPValue(b []byte, signed bool) int64 {
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	if signed && b[0]&0x80 != 0 {
+		return int64(value) - int64(1)<<(8*uint(len(b)))
+	}
+	return int64(value)
+}
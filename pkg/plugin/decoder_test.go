@@ -0,0 +1,113 @@
+package plugin_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+// rawUplink returns a TTN uplink message with the payload, and the decoded payload if not empty.
+func rawUplink(device, devEUI string, fPort int, payload []byte, decoded string) string {
+	if decoded == "" {
+		decoded = "null"
+	}
+	return fmt.Sprintf(`{
+		"end_device_ids": {"device_id": %q, "dev_eui": %q},
+		"uplink_message": {"f_port": %d, "frm_payload": %q, "decoded_payload": %s}
+	}`, device, devEUI, fPort, base64.StdEncoding.EncodeToString(payload), decoded)
+}
+
+func TestDecoderRules(t *testing.T) {
+	var decoders []plugin.DecoderRule
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"fPort": 1, "decoder": "lpp"},
+		{"deviceId": "meter-.*", "decoder": "struct", "byteOrder": "little", "layout": [
+			{"name": "energy", "type": "uint32"},
+			{"name": "temperature", "type": "int16", "scale": 0.01},
+			{"type": "uint8"},
+			{"name": "voltage", "type": "float32"}
+		]},
+		{"devEuiFrom": "70B3D57ED0000000", "devEuiTo": "70-B3-D5-7E-D0-FF-FF-FF", "decoder": "decoded_payload"}
+	]`), &decoders))
+
+	cborPayload, err := cbor.Marshal(map[string]interface{}{"t": 1234})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		message string
+		body    map[string]interface{}
+	}{
+		{
+			name:    "lpp by f_port",
+			message: rawUplink("tank-1", "0000000000000001", 1, []byte{0x01, 0x67, 0x01, 0x10, 0x02, 0x68, 0x50, 0x03, 0x71, 0x04, 0xD2, 0xFB, 0x2E, 0x00, 0x00}, ""),
+			body: map[string]interface{}{
+				"temperature_1": 27.2, "relative_humidity_2": 40.0,
+				"accelerometer_3_x": 1.234, "accelerometer_3_y": -1.234, "accelerometer_3_z": 0.0,
+			},
+		},
+		{
+			name:    "lpp gps",
+			message: rawUplink("tracker-1", "0000000000000001", 1, []byte{0x01, 0x88, 0x06, 0x76, 0x5F, 0xF2, 0x96, 0x0A, 0x00, 0x03, 0xE8}, ""),
+			body:    map[string]interface{}{"gps_1_latitude": 42.3519, "gps_1_longitude": -87.9094, "gps_1_altitude": 10.0},
+		},
+		{
+			name:    "struct by device ID",
+			message: rawUplink("meter-7", "0000000000000001", 2, []byte{0x10, 0x27, 0x00, 0x00, 0x18, 0xFC, 0xFF, 0x00, 0x00, 0x40, 0x40}, ""),
+			body:    map[string]interface{}{"energy": 10000.0, "temperature": -10.0, "voltage": 3.0},
+		},
+		{
+			name:    "decoded payload by DevEUI range",
+			message: rawUplink("pump-1", "70B3D57ED0045669", 2, []byte{0x00}, `{"pressure": 1.5, "on": true}`),
+			body:    map[string]interface{}{"pressure": 1.5, "on": true},
+		},
+		{
+			name:    "cbor by default",
+			message: rawUplink("tank-1", "70B3D57ED1000000", 2, cborPayload, ""),
+			body:    map[string]interface{}{"t": 1234.0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := plugin.ToFrames("all", []mqtt.Message{{Timestamp: time.Unix(1, 0), Value: tt.message}},
+				plugin.FrameOptions{Layout: plugin.FrameLayoutPerDevice, Decoders: decoders})
+			require.Len(t, frames, 1)
+
+			body := make(map[string]interface{})
+			for _, field := range frames[0].Fields[1:] {
+				val, ok := field.ConcreteAt(0)
+				require.True(t, ok, field.Name)
+				body[field.Name] = val
+			}
+			require.Len(t, body, len(tt.body))
+			for key, val := range tt.body {
+				if f, ok := val.(float64); ok {
+					require.InDelta(t, f, body[key], 1e-9, key)
+				} else {
+					require.Equal(t, val, body[key], key)
+				}
+			}
+		})
+	}
+
+	t.Run("invalid rules", func(t *testing.T) {
+		for _, rules := range []string{
+			`[{"decoder": "protobuf"}]`,
+			`[{"decoder": "struct"}]`,
+			`[{"decoder": "struct", "layout": [{"name": "x", "type": "uint24"}]}]`,
+			`[{"decoder": "struct", "byteOrder": "middle", "layout": [{"name": "x", "type": "uint8"}]}]`,
+			`[{"decoder": "lpp", "deviceId": "tank-("}]`,
+			`[{"decoder": "lpp", "devEuiFrom": "not-hex"}]`,
+		} {
+			var decoders []plugin.DecoderRule
+			require.Error(t, json.Unmarshal([]byte(rules), &decoders), rules)
+		}
+	})
+}
@@ -0,0 +1,432 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+)
+
+// downlinkPath is the Grafana Live path that downlinks are published to,
+// i.e. channel ds/<uid>/downlink.
+const downlinkPath = "downlink"
+
+// downlinkCorrelationPrefix marks the correlation IDs of downlinks sent from Grafana.
+const downlinkCorrelationPrefix = "grafana:downlink:"
+
+// Downlink is a LoRaWAN downlink published from Grafana Live.
+type Downlink struct {
+	// Application and tenant of the device. Defaults to the MQTT username, e.g. luppy-application@ttn.
+	ApplicationID string `json:"application_id"`
+	TenantID      string `json:"tenant_id"`
+
+	DeviceID  string `json:"device_id"`
+	FPort     int    `json:"f_port"`
+	Confirmed bool   `json:"confirmed"`
+	Priority  string `json:"priority"`
+	// Replace the downlink queue instead of pushing to it.
+	Replace bool `json:"replace"`
+
+	// Encoding of the payload: cbor (default) encodes a JSON object as CBOR,
+	// json sends the JSON as-is and raw expects a base64 string.
+	Encoding string          `json:"encoding"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// ttnDownlinks is the body of a message published to down/push or down/replace.
+// See https://www.thethingsindustries.com/docs/integrations/mqtt/#scheduling-downlinks
+type ttnDownlinks struct {
+	Downlinks []ttnDownlink `json:"downlinks"`
+}
+
+type ttnDownlink struct {
+	FPort          int      `json:"f_port"`
+	FrmPayload     []byte   `json:"frm_payload"`
+	Priority       string   `json:"priority"`
+	Confirmed      bool     `json:"confirmed"`
+	CorrelationIDs []string `json:"correlation_ids,omitempty"`
+}
+
+var downlinkPriorities = map[string]bool{
+	"LOWEST":       true,
+	"LOW":          true,
+	"BELOW_NORMAL": true,
+	"NORMAL":       true,
+	"ABOVE_NORMAL": true,
+	"HIGH":         true,
+	"HIGHEST":      true,
+}
+
+// ttnID is the syntax of the device, application and tenant IDs of The Things Network.
+// IDs are part of the MQTT topic, so anything else could publish to other topics.
+var ttnID = regexp.MustCompile(`^[a-z0-9](?:[-]?[a-z0-9]){2,}$`)
+
+// roles in ascending order of permissions.
+var roles = map[string]int{
+	"Viewer": 1,
+	"Editor": 2,
+	"Admin":  3,
+}
+
+// hasRole returns true if the user has at least the required role.
+// Nobody has an unknown required role.
+func hasRole(user *backend.User, required string) bool {
+	if user == nil {
+		return false
+	}
+	if required == "" {
+		required = "Editor"
+	}
+	needed, ok := roles[required]
+	if !ok {
+		return false
+	}
+	rank, ok := roles[user.Role]
+	return ok && rank >= needed
+}
+
+// encodeDownlink returns the MQTT topic and message for the downlink published in data.
+// username is the MQTT username, used as the default application@tenant.
+func encodeDownlink(data json.RawMessage, username string) (string, []byte, string, error) {
+	var d Downlink
+	if err := json.Unmarshal(data, &d); err != nil {
+		return "", nil, "", fmt.Errorf("invalid downlink: %w", err)
+	}
+
+	if d.DeviceID == "" {
+		return "", nil, "", errors.New("invalid downlink: device_id missing")
+	}
+	for _, id := range []struct{ name, value string }{
+		{"device_id", d.DeviceID},
+		{"application_id", d.ApplicationID},
+		{"tenant_id", d.TenantID},
+	} {
+		if id.value != "" && !ttnID.MatchString(id.value) {
+			return "", nil, "", fmt.Errorf("invalid downlink: %s %q must be lowercase letters, digits and dashes", id.name, id.value)
+		}
+	}
+	if d.FPort < 1 || d.FPort > 223 {
+		return "", nil, "", fmt.Errorf("invalid downlink: f_port %d must be between 1 and 223", d.FPort)
+	}
+	if d.Priority == "" {
+		d.Priority = "NORMAL"
+	}
+	if !downlinkPriorities[d.Priority] {
+		return "", nil, "", fmt.Errorf("invalid downlink: unknown priority %s", d.Priority)
+	}
+
+	application := username
+	if d.ApplicationID != "" {
+		tenant := d.TenantID
+		if tenant == "" {
+			tenant = "ttn"
+		}
+		application = d.ApplicationID + "@" + tenant
+	}
+	if application == "" {
+		return "", nil, "", errors.New("invalid downlink: application_id missing")
+	}
+
+	payload, err := encodeDownlinkPayload(d.Encoding, d.Payload)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("invalid downlink payload: %w", err)
+	}
+
+	correlationID, err := newCorrelationID()
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	message, err := json.Marshal(ttnDownlinks{
+		Downlinks: []ttnDownlink{{
+			FPort:          d.FPort,
+			FrmPayload:     payload,
+			Priority:       d.Priority,
+			Confirmed:      d.Confirmed,
+			CorrelationIDs: []string{correlationID},
+		}},
+	})
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	operation := "push"
+	if d.Replace {
+		operation = "replace"
+	}
+	topic := fmt.Sprintf("v3/%s/devices/%s/down/%s", application, d.DeviceID, operation)
+	return topic, message, correlationID, nil
+}
+
+// encodeDownlinkPayload returns the bytes of the payload in the requested encoding.
+func encodeDownlinkPayload(encoding string, payload json.RawMessage) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("payload missing")
+	}
+
+	switch strings.ToLower(encoding) {
+	case "", "cbor":
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		return cbor.Marshal(cborValue(value))
+
+	case "json":
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, payload); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case "raw":
+		var encoded string
+		if err := json.Unmarshal(payload, &encoded); err != nil {
+			return nil, errors.New("raw payload must be a base64 string")
+		}
+		return base64.StdEncoding.DecodeString(encoded)
+
+	default:
+		return nil, fmt.Errorf("unknown encoding %s", encoding)
+	}
+}
+
+// cborValue converts JSON numbers to integers where possible, so they are
+// encoded as compact CBOR integers instead of floats.
+func cborValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = cborValue(val)
+		}
+		return v
+	case []interface{}:
+		for idx, val := range v {
+			v[idx] = cborValue(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func newCorrelationID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return downlinkCorrelationPrefix + hex.EncodeToString(id), nil
+}
+
+// downlinkStates are the downlink events, in lifecycle order.
+var downlinkStates = []string{"queued", "sent", "ack", "nack", "failed"}
+
+// downlinkStateRank orders the states. ack, nack and failed are final.
+var downlinkStateRank = map[string]int{
+	"queued": 1,
+	"sent":   2,
+	"ack":    3,
+	"nack":   3,
+	"failed": 3,
+}
+
+// ttnDownlinkEvent is a message published to down/queued, down/sent, down/ack, down/nack or down/failed.
+type ttnDownlinkEvent struct {
+	EndDeviceIDs struct {
+		DeviceID string `json:"device_id"`
+	} `json:"end_device_ids"`
+	CorrelationIDs []string  `json:"correlation_ids"`
+	ReceivedAt     time.Time `json:"received_at"`
+
+	DownlinkQueued *ttnDownlink `json:"downlink_queued"`
+	DownlinkSent   *ttnDownlink `json:"downlink_sent"`
+	DownlinkAck    *ttnDownlink `json:"downlink_ack"`
+	DownlinkNack   *ttnDownlink `json:"downlink_nack"`
+	DownlinkFailed *struct {
+		Downlink ttnDownlink `json:"downlink"`
+		Error    struct {
+			Name          string `json:"name"`
+			MessageFormat string `json:"message_format"`
+		} `json:"error"`
+	} `json:"downlink_failed"`
+}
+
+// downlink returns the downlink the event refers to.
+func (e *ttnDownlinkEvent) downlink() *ttnDownlink {
+	switch {
+	case e.DownlinkQueued != nil:
+		return e.DownlinkQueued
+	case e.DownlinkSent != nil:
+		return e.DownlinkSent
+	case e.DownlinkAck != nil:
+		return e.DownlinkAck
+	case e.DownlinkNack != nil:
+		return e.DownlinkNack
+	case e.DownlinkFailed != nil:
+		return &e.DownlinkFailed.Downlink
+	}
+	return nil
+}
+
+// downlinkStatus is the lifecycle of a downlink.
+type downlinkStatus struct {
+	correlationID string
+	deviceID      string
+	fPort         int
+	firstSeen     time.Time
+	state         string
+	times         map[string]time.Time
+	err           string
+}
+
+// downlinkStatusFrame correlates the downlink events by correlation ID and
+// returns a frame with one row per downlink: its lifecycle timestamps and final state.
+func downlinkStatusFrame(name string, messages []mqtt.Message) *data.Frame {
+	statuses := make(map[string]*downlinkStatus)
+	for _, m := range messages {
+		state := path.Base(m.Topic)
+		if _, ok := downlinkStateRank[state]; !ok {
+			continue
+		}
+
+		var event ttnDownlinkEvent
+		if err := json.Unmarshal([]byte(m.Value), &event); err != nil {
+			log.DefaultLogger.Debug(fmt.Sprintf("downlinkStatusFrame: Decode error %s", err.Error()))
+			continue
+		}
+		downlink := event.downlink()
+
+		ids := event.CorrelationIDs
+		if downlink != nil {
+			ids = append(ids, downlink.CorrelationIDs...)
+		}
+		id := downlinkCorrelationID(ids)
+		if id == "" {
+			continue
+		}
+
+		timestamp := m.Timestamp
+		if !event.ReceivedAt.IsZero() {
+			timestamp = event.ReceivedAt
+		}
+
+		status, ok := statuses[id]
+		if !ok {
+			status = &downlinkStatus{
+				correlationID: id,
+				firstSeen:     timestamp,
+				times:         make(map[string]time.Time),
+			}
+			statuses[id] = status
+		}
+		if event.EndDeviceIDs.DeviceID != "" {
+			status.deviceID = event.EndDeviceIDs.DeviceID
+		}
+		if downlink != nil && downlink.FPort != 0 {
+			status.fPort = downlink.FPort
+		}
+		if event.DownlinkFailed != nil {
+			status.err = event.DownlinkFailed.Error.MessageFormat
+			if status.err == "" {
+				status.err = event.DownlinkFailed.Error.Name
+			}
+		}
+		if timestamp.Before(status.firstSeen) {
+			status.firstSeen = timestamp
+		}
+		status.times[state] = timestamp
+
+		// the final state has the highest rank, the latest one wins a tie
+		if status.state == "" || downlinkStateRank[state] > downlinkStateRank[status.state] ||
+			(downlinkStateRank[state] == downlinkStateRank[status.state] && !timestamp.Before(status.times[status.state])) {
+			status.state = state
+		}
+	}
+
+	// order the downlinks by first seen
+	list := make([]*downlinkStatus, 0, len(statuses))
+	for _, status := range statuses {
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].firstSeen.Equal(list[j].firstSeen) {
+			return list[i].firstSeen.Before(list[j].firstSeen)
+		}
+		return list[i].correlationID < list[j].correlationID
+	})
+
+	count := len(list)
+	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, count)
+	timeField.Name = "Time"
+	idField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	idField.Name = "correlation_id"
+	deviceField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	deviceField.Name = "device_id"
+	portField := data.NewFieldFromFieldType(data.FieldTypeNullableInt64, count)
+	portField.Name = "f_port"
+	stateField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	stateField.Name = "state"
+	stateTimeFields := make([]*data.Field, len(downlinkStates))
+	for idx, state := range downlinkStates {
+		stateTimeFields[idx] = data.NewFieldFromFieldType(data.FieldTypeNullableTime, count)
+		stateTimeFields[idx].Name = state + "_at"
+	}
+	errorField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	errorField.Name = "error"
+
+	for row, status := range list {
+		timeField.Set(row, status.firstSeen)
+		idField.Set(row, status.correlationID)
+		deviceField.Set(row, status.deviceID)
+		if status.fPort != 0 {
+			portField.SetConcrete(row, int64(status.fPort))
+		}
+		stateField.Set(row, status.state)
+		for idx, state := range downlinkStates {
+			if t, ok := status.times[state]; ok {
+				stateTimeFields[idx].SetConcrete(row, t)
+			}
+		}
+		errorField.Set(row, status.err)
+	}
+
+	frame := data.NewFrame(name, timeField, idField, deviceField, portField, stateField)
+	frame.Fields = append(frame.Fields, stateTimeFields...)
+	frame.Fields = append(frame.Fields, errorField)
+	return frame
+}
+
+// downlinkCorrelationID picks the ID that identifies a downlink across its events:
+// the ID set by PublishStream, or else the ID assigned by the Application Server.
+func downlinkCorrelationID(ids []string) string {
+	for _, prefix := range []string{downlinkCorrelationPrefix, "as:downlink:"} {
+		for _, id := range ids {
+			if strings.HasPrefix(id, prefix) {
+				return id
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,197 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishStreamDownlink(t *testing.T) {
+	publish := func(ds *plugin.MQTTDatasource, role string, data string) (*backend.PublishStreamResponse, error) {
+		return ds.PublishStream(context.Background(), &backend.PublishStreamRequest{
+			PluginContext: backend.PluginContext{User: &backend.User{Login: "test", Role: role}},
+			Path:          "downlink",
+			Data:          json.RawMessage(data),
+		})
+	}
+	newDatasource := func(enabled bool) (*plugin.MQTTDatasource, *fakeMQTTClient) {
+		client := &fakeMQTTClient{connected: true}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+		ds.Settings.Username = "luppy-application@ttn"
+		ds.Settings.EnableDownlinks = enabled
+		return ds, client
+	}
+
+	t.Run("denied when downlinks are disabled", func(t *testing.T) {
+		ds, client := newDatasource(false)
+		res, err := publish(ds, "Admin", `{"device_id": "tank-1", "f_port": 2, "payload": {"led": 1}}`)
+		require.NoError(t, err)
+		require.Equal(t, backend.PublishStreamStatusPermissionDenied, res.Status)
+		require.Empty(t, client.published)
+	})
+
+	t.Run("denied for viewers", func(t *testing.T) {
+		ds, client := newDatasource(true)
+		res, err := publish(ds, "Viewer", `{"device_id": "tank-1", "f_port": 2, "payload": {"led": 1}}`)
+		require.NoError(t, err)
+		require.Equal(t, backend.PublishStreamStatusPermissionDenied, res.Status)
+		require.Empty(t, client.published)
+	})
+
+	t.Run("denied for an unknown downlink role", func(t *testing.T) {
+		ds, client := newDatasource(true)
+		ds.Settings.DownlinkRole = "Editr"
+		res, err := publish(ds, "Admin", `{"device_id": "tank-1", "f_port": 2, "payload": {"led": 1}}`)
+		require.NoError(t, err)
+		require.Equal(t, backend.PublishStreamStatusPermissionDenied, res.Status)
+		require.Empty(t, client.published)
+
+		_, err = plugin.NewMQTTInstance(backend.DataSourceInstanceSettings{
+			UID:      "xyz",
+			JSONData: []byte(`{"host": "127.0.0.1", "port": 1, "enableDownlinks": true, "downlinkRole": "Editr"}`),
+		})
+		require.EqualError(t, err, `invalid downlink role "Editr": must be Viewer, Editor or Admin`)
+	})
+
+	t.Run("pushes a CBOR downlink", func(t *testing.T) {
+		ds, client := newDatasource(true)
+		res, err := publish(ds, "Editor", `{"device_id": "tank-1", "f_port": 2, "confirmed": true, "payload": {"led": 1}}`)
+		require.NoError(t, err)
+		require.Equal(t, backend.PublishStreamStatusOK, res.Status)
+
+		message, ok := client.published["v3/luppy-application@ttn/devices/tank-1/down/push"]
+		require.True(t, ok)
+
+		var body struct {
+			Downlinks []struct {
+				FPort          int      `json:"f_port"`
+				FrmPayload     []byte   `json:"frm_payload"`
+				Priority       string   `json:"priority"`
+				Confirmed      bool     `json:"confirmed"`
+				CorrelationIDs []string `json:"correlation_ids"`
+			} `json:"downlinks"`
+		}
+		require.NoError(t, json.Unmarshal(message, &body))
+		require.Len(t, body.Downlinks, 1)
+		downlink := body.Downlinks[0]
+		require.Equal(t, 2, downlink.FPort)
+		require.Equal(t, "NORMAL", downlink.Priority)
+		require.True(t, downlink.Confirmed)
+		require.Len(t, downlink.CorrelationIDs, 1)
+		require.True(t, strings.HasPrefix(downlink.CorrelationIDs[0], "grafana:downlink:"))
+
+		var payload map[string]interface{}
+		require.NoError(t, cbor.Unmarshal(downlink.FrmPayload, &payload))
+		require.Equal(t, map[string]interface{}{"led": uint64(1)}, payload)
+	})
+
+	t.Run("replaces the queue with a raw downlink", func(t *testing.T) {
+		ds, client := newDatasource(true)
+		res, err := publish(ds, "Admin", `{"application_id": "other", "tenant_id": "acme", "device_id": "tank-1", "f_port": 10, "replace": true, "priority": "HIGH", "encoding": "raw", "payload": "AQI="}`)
+		require.NoError(t, err)
+		require.Equal(t, backend.PublishStreamStatusOK, res.Status)
+		require.Contains(t, string(client.published["v3/other@acme/devices/tank-1/down/replace"]), `"frm_payload":"AQI="`)
+	})
+
+	t.Run("invalid downlinks are rejected", func(t *testing.T) {
+		ds, client := newDatasource(true)
+		for _, data := range []string{
+			`{"f_port": 2, "payload": {}}`,
+			`{"device_id": "tank-1", "f_port": 0, "payload": {}}`,
+			`{"device_id": "tank-1", "f_port": 2, "priority": "URGENT", "payload": {}}`,
+			`{"device_id": "tank-1", "f_port": 2, "encoding": "raw", "payload": {}}`,
+			`{"device_id": "tank-1", "f_port": 2}`,
+			`{"device_id": "x/../#", "f_port": 2, "payload": {}}`,
+			`{"device_id": "tank-+", "f_port": 2, "payload": {}}`,
+			`{"device_id": "#", "f_port": 2, "payload": {}}`,
+			`{"device_id": "tank/1", "f_port": 2, "payload": {}}`,
+			`{"device_id": "Tank-1", "f_port": 2, "payload": {}}`,
+			`{"device_id": "tank--1", "f_port": 2, "payload": {}}`,
+			`{"device_id": "tank-1", "application_id": "app/+", "f_port": 2, "payload": {}}`,
+			`{"device_id": "tank-1", "application_id": "app", "tenant_id": "ttn/#", "f_port": 2, "payload": {}}`,
+		} {
+			_, err := publish(ds, "Admin", data)
+			require.Error(t, err, data)
+		}
+		require.Empty(t, client.published)
+	})
+}
+
+func TestDownlinkStatusQuery(t *testing.T) {
+	event := func(state string, body string, at int64) mqtt.Message {
+		return mqtt.Message{
+			Timestamp: time.Unix(at, 0),
+			Topic:     "v3/luppy-application@ttn/devices/tank-1/down/" + state,
+			Value: fmt.Sprintf(`{
+				"end_device_ids": {"device_id": "tank-1"},
+				"correlation_ids": ["as:downlink:01", "grafana:downlink:abc"],
+				"received_at": %q,
+				%s
+			}`, time.Unix(at, 0).UTC().Format(time.RFC3339Nano), body),
+		}
+	}
+	client := &fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"downlinks": {
+				event("queued", `"downlink_queued": {"f_port": 2, "frm_payload": "oWNsZWQB"}`, 10),
+				event("sent", `"downlink_sent": {"f_port": 2, "frm_payload": "oWNsZWQB"}`, 20),
+				event("ack", `"downlink_ack": {"f_port": 2, "frm_payload": "oWNsZWQB"}`, 30),
+				{
+					Timestamp: time.Unix(40, 0),
+					Topic:     "v3/luppy-application@ttn/devices/tank-2/down/failed",
+					Value: `{
+						"end_device_ids": {"device_id": "tank-2"},
+						"correlation_ids": ["as:downlink:02"],
+						"downlink_failed": {
+							"downlink": {"f_port": 3},
+							"error": {"name": "no_device_session", "message_format": "no device session"}
+						}
+					}`,
+				},
+			},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	res := ds.Query(backend.DataQuery{QueryType: "downlinks", JSON: []byte(`{}`)})
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 1)
+	frame := res.Frames[0]
+	require.Equal(t, 2, frame.Rows())
+
+	row := func(idx int) map[string]interface{} {
+		values := make(map[string]interface{})
+		for _, field := range frame.Fields {
+			if v, ok := field.ConcreteAt(idx); ok {
+				values[field.Name] = v
+			}
+		}
+		return values
+	}
+
+	first := row(0)
+	require.Equal(t, "grafana:downlink:abc", first["correlation_id"])
+	require.Equal(t, "tank-1", first["device_id"])
+	require.Equal(t, int64(2), first["f_port"])
+	require.Equal(t, "ack", first["state"])
+	require.Equal(t, time.Unix(10, 0).UTC(), first["queued_at"])
+	require.Equal(t, time.Unix(30, 0).UTC(), first["ack_at"])
+	require.NotContains(t, first, "failed_at")
+
+	second := row(1)
+	require.Equal(t, "as:downlink:02", second["correlation_id"])
+	require.Equal(t, "failed", second["state"])
+	require.Equal(t, int64(3), second["f_port"])
+	require.Equal(t, time.Unix(40, 0), second["failed_at"])
+	require.Equal(t, "no device session", second["error"])
+}
@@ -0,0 +1,537 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprNode is a node of a parsed expression, evaluated against a decoded record.
+// eval returns nil if the value is missing, e.g. a field the record doesn't have.
+type exprNode interface {
+	eval(r record) interface{}
+}
+
+// Token kinds of the expression lexer.
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+// Operators of the expression language, longest first so the lexer matches greedily.
+var exprOperators = []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%"}
+
+// lexExpr splits the expression into tokens.
+func lexExpr(text string) ([]token, error) {
+	var tokens []token
+	pos := 0
+	for pos < len(text) {
+		c := rune(text[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: pos})
+			pos++
+
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: pos})
+			pos++
+
+		case c == '"' || c == '\'':
+			end := pos + 1
+			for end < len(text) && text[end] != text[pos] {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("unterminated string at %d", pos)
+			}
+			s, err := unquote(text[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %w", pos, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: s, pos: pos})
+			pos = end + 1
+
+		case unicode.IsDigit(c) || (c == '.' && pos+1 < len(text) && unicode.IsDigit(rune(text[pos+1]))):
+			end := pos
+			for end < len(text) && (unicode.IsDigit(rune(text[end])) || strings.ContainsRune(".eE", rune(text[end])) ||
+				((text[end] == '-' || text[end] == '+') && strings.ContainsRune("eE", rune(text[end-1])))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text[pos:end], pos: pos})
+			pos = end
+
+		case c == '_' || unicode.IsLetter(c):
+			end := pos
+			for end < len(text) && (text[end] == '_' || text[end] == '.' ||
+				unicode.IsLetter(rune(text[end])) || unicode.IsDigit(rune(text[end]))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: text[pos:end], pos: pos})
+			pos = end
+
+		default:
+			op := ""
+			for _, o := range exprOperators {
+				if strings.HasPrefix(text[pos:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, pos)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: pos})
+			pos += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(text)}), nil
+}
+
+// unquote returns the contents of a single or double quoted string.
+func unquote(s string) (string, error) {
+	if s[0] == '\'' {
+		s = `"` + strings.ReplaceAll(strings.ReplaceAll(s[1:len(s)-1], `\'`, `'`), `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+// exprParser is a recursive descent parser for the expression language:
+//
+//	or      = and { ("OR" | "||") and }
+//	and     = not { ("AND" | "&&") not }
+//	not     = ("NOT" | "!") not | compare
+//	compare = sum [ ("==" | "!=" | "<" | "<=" | ">" | ">=") sum | ("=~" | "!~") string ]
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | operand
+//	operand = identifier | number | string | "true" | "false" | "(" or ")"
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+// parseExpr parses the expression text.
+func parseExpr(text string) (exprNode, error) {
+	tokens, err := lexExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is one of the operators or keywords.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokenOp && tok.kind != tokenIdent {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.text == op || (tok.kind == tokenIdent && strings.EqualFold(tok.text, op)) {
+			p.next()
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("OR", "||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{or: true, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("AND", "&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("NOT", "!"); ok {
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: node}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	if op, ok := p.accept("=~", "!~"); ok {
+		tok := p.next()
+		if tok.kind != tokenString {
+			return nil, fmt.Errorf("expected a quoted regular expression after %s at %d", op, tok.pos)
+		}
+		re, err := regexp.Compile("^(?:" + tok.text + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at %d: %w", tok.pos, err)
+		}
+		return matchNode{negate: op == "!~", node: left, re: re}, nil
+	}
+
+	if op, ok := p.accept("==", "!=", "<=", ">=", "<", ">"); ok {
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = arithNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = arithNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return arithNode{op: "-", left: literalNode{value: 0.0}, right: node}, nil
+	}
+	return p.parseOperand()
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ) at %d", closing.pos)
+		}
+		return node, nil
+
+	case tokenNumber:
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", tok.text, tok.pos)
+		}
+		return literalNode{value: value}, nil
+
+	case tokenString:
+		return literalNode{value: tok.text}, nil
+
+	case tokenIdent:
+		switch strings.ToLower(tok.text) {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		case "and", "or", "not":
+			return nil, fmt.Errorf("unexpected %s at %d", tok.text, tok.pos)
+		}
+		return identNode{name: tok.text}, nil
+
+	case tokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+
+	default:
+		return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+	}
+}
+
+// identNode is a field of the record: a decoded field, a device label or uplink metadata.
+type identNode struct {
+	name string
+}
+
+func (n identNode) eval(r record) interface{} {
+	return lookup(r, n.name)
+}
+
+// lookup returns the value of the name in the record, or nil if the record doesn't have it.
+// Decoded fields take precedence over device labels and uplink metadata.
+func lookup(r record, name string) interface{} {
+	if val, ok := r.body[name]; ok {
+		return normalize(val)
+	}
+	if val, ok := r.labels[name]; ok {
+		return val
+	}
+	if r.labels != nil {
+		switch name {
+		case "f_port":
+			return float64(r.uplink.UplinkMessage.FPort)
+		}
+	}
+	return nil
+}
+
+// normalize converts the numbers decoded from CBOR and JSON to float64.
+func normalize(val interface{}) interface{} {
+	switch v := val.(type) {
+	case uint64:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return val
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n literalNode) eval(_ record) interface{} {
+	return n.value
+}
+
+type notNode struct {
+	node exprNode
+}
+
+func (n notNode) eval(r record) interface{} {
+	return !truthy(n.node.eval(r))
+}
+
+type logicNode struct {
+	or          bool
+	left, right exprNode
+}
+
+func (n logicNode) eval(r record) interface{} {
+	if n.or {
+		return truthy(n.left.eval(r)) || truthy(n.right.eval(r))
+	}
+	return truthy(n.left.eval(r)) && truthy(n.right.eval(r))
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+// eval compares numbers, strings or booleans. Missing values never compare.
+// Values of different types are only unequal.
+func (n compareNode) eval(r record) interface{} {
+	left, right := n.left.eval(r), n.right.eval(r)
+	if left == nil || right == nil {
+		return false
+	}
+
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return n.op == "!="
+		}
+		cmp = compareFloats(l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return n.op == "!="
+		}
+		cmp = strings.Compare(l, r)
+	case bool:
+		r, ok := right.(bool)
+		if !ok || (n.op != "==" && n.op != "!=") {
+			return n.op == "!="
+		}
+		if l != r {
+			cmp = 1
+		}
+	default:
+		return false
+	}
+
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// arithNode applies an arithmetic operator to two numbers. Strings can be joined with +.
+// The result is missing if an operand is missing or not a number, or on division by zero.
+type arithNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n arithNode) eval(r record) interface{} {
+	left, right := n.left.eval(r), n.right.eval(r)
+	if ls, ok := left.(string); ok && n.op == "+" {
+		if rs, ok := right.(string); ok {
+			return ls + rs
+		}
+	}
+
+	l, ok := left.(float64)
+	if !ok {
+		return nil
+	}
+	rv, ok := right.(float64)
+	if !ok {
+		return nil
+	}
+	switch n.op {
+	case "+":
+		return l + rv
+	case "-":
+		return l - rv
+	case "*":
+		return l * rv
+	case "/":
+		if rv == 0 {
+			return nil
+		}
+		return l / rv
+	case "%":
+		if rv == 0 {
+			return nil
+		}
+		return math.Mod(l, rv)
+	}
+	return nil
+}
+
+// matchNode matches a string value against an anchored regular expression.
+type matchNode struct {
+	negate bool
+	node   exprNode
+	re     *regexp.Regexp
+}
+
+func (n matchNode) eval(r record) interface{} {
+	s, ok := n.node.eval(r).(string)
+	if !ok {
+		return false
+	}
+	return n.re.MatchString(s) != n.negate
+}
+
+func truthy(val interface{}) bool {
+	b, ok := val.(bool)
+	return ok && b
+}
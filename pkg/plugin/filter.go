@@ -0,0 +1,52 @@
+package plugin
+
+import "fmt"
+
+// Filter selects the decoded records to include in the frames, e.g.
+//
+//	device_id =~ "tank-.*" AND battery < 3.3
+//
+// Identifiers refer to decoded fields, device labels or the f_port of the uplink.
+type Filter struct {
+	text string
+	expr exprNode
+}
+
+// ParseFilter parses the filter expression. An empty expression returns a nil filter.
+func ParseFilter(text string) (*Filter, error) {
+	if text == "" {
+		return nil, nil
+	}
+	expr, err := parseExpr(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", text, err)
+	}
+	return &Filter{text: text, expr: expr}, nil
+}
+
+// String returns the filter expression.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.text
+}
+
+// match returns true if the record satisfies the filter. A nil filter matches every record.
+func (f *Filter) match(r record) bool {
+	return f == nil || truthy(f.expr.eval(r))
+}
+
+// filterRecords returns the records that satisfy the filter.
+func filterRecords(records []record, f *Filter) []record {
+	if f == nil {
+		return records
+	}
+	matched := make([]record, 0, len(records))
+	for _, r := range records {
+		if f.match(r) {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
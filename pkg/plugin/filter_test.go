@@ -0,0 +1,85 @@
+package plugin_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	messages := []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"battery": 3.2, "l": 1000})},
+		{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-2", map[string]interface{}{"battery": 3.6, "l": 2000})},
+		{Timestamp: time.Unix(3, 0), Value: uplink(t, "pump-1", map[string]interface{}{"battery": 3.0, "on": true})},
+		{Timestamp: time.Unix(4, 0), Value: `{"battery": 2.9, "name": "plain"}`},
+	}
+
+	tests := []struct {
+		filter string
+		times  []int64
+	}{
+		{filter: "", times: []int64{1, 2, 3, 4}},
+		{filter: `device_id =~ "tank-.*" AND battery < 3.3`, times: []int64{1}},
+		{filter: `device_id !~ 'tank-.*'`, times: []int64{3}},
+		{filter: `f_port == 2`, times: []int64{1, 2, 3}},
+		{filter: `l >= 1000 && l < 2000 || on`, times: []int64{1, 3}},
+		{filter: `NOT (battery > 3.1)`, times: []int64{3, 4}},
+		{filter: `on == true`, times: []int64{3}},
+		{filter: `name != "plain"`, times: []int64{}},
+		{filter: `device_id == "tank-2"`, times: []int64{2}},
+		{filter: `missing > 0`, times: []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			filter, err := plugin.ParseFilter(tt.filter)
+			require.NoError(t, err)
+			frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Filter: filter})
+			require.Len(t, frames, 1)
+
+			times := make([]int64, frames[0].Rows())
+			for row := range times {
+				times[row] = frames[0].Fields[0].At(row).(time.Time).Unix()
+			}
+			require.Equal(t, tt.times, times)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, text := range []string{`battery <`, `device_id =~ tank`, `(l > 1`, `l > 1 )`, `"open`, `l # 1`, `device_id =~ "("`} {
+			_, err := plugin.ParseFilter(text)
+			require.Error(t, err, text)
+		}
+	})
+}
+
+func TestQueryFilter(t *testing.T) {
+	ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"all": {
+				{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"battery": 3.2})},
+				{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-2", map[string]interface{}{"battery": 3.6})},
+			},
+		},
+	}, "xyz")
+
+	query := func(filter string) backend.DataResponse {
+		return ds.Query(backend.DataQuery{
+			JSON: []byte(fmt.Sprintf(`{"queryText": "all", "filter": %q}`, filter)),
+		})
+	}
+
+	res := query("battery < 3.3")
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 1)
+	require.Equal(t, 1, res.Frames[0].Rows())
+
+	res = query("battery <")
+	require.Error(t, res.Error)
+	require.Empty(t, res.Frames)
+}
@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// sinceLastUplinkField is the synthetic field with the seconds since the last uplink of a device.
+const sinceLastUplinkField = "seconds_since_last_uplink"
+
+// defaultHeartbeat is the interval of the heartbeat frames of a stream.
+const defaultHeartbeat = 10 * time.Second
+
+// lastUplink is the time of the last uplink of a device.
+type lastUplink struct {
+	labels data.Labels
+	at     time.Time
+}
+
+// withSinceLastUplink sets seconds_since_last_uplink to 0 in every record, and if now is
+// set, appends a record per device at now with the seconds since its last uplink.
+// Records after now are not counted as the last uplink.
+func withSinceLastUplink(records []record, now time.Time) []record {
+	devices := make(map[string]*lastUplink)
+	out := make([]record, 0, len(records))
+	for _, r := range records {
+		body := make(map[string]interface{}, len(r.body)+1)
+		for key, val := range r.body {
+			body[key] = val
+		}
+		body[sinceLastUplinkField] = float64(0)
+		r.body = body
+		out = append(out, r)
+
+		if now.IsZero() || r.timestamp.After(now) {
+			continue
+		}
+		key := r.labels.String()
+		if last, ok := devices[key]; !ok || r.timestamp.After(last.at) {
+			devices[key] = &lastUplink{labels: r.labels, at: r.timestamp}
+		}
+	}
+	return append(out, sinceLastUplinkRecords(devices, now)...)
+}
+
+// sinceLastUplinkRecords returns a record per device at now, with the seconds since its
+// last uplink, ordered by device.
+func sinceLastUplinkRecords(devices map[string]*lastUplink, now time.Time) []record {
+	keys := make([]string, 0, len(devices))
+	for key := range devices {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([]record, 0, len(keys))
+	for _, key := range keys {
+		last := devices[key]
+		records = append(records, record{
+			timestamp: now,
+			body:      map[string]interface{}{sinceLastUplinkField: now.Sub(last.at).Seconds()},
+			labels:    last.labels,
+		})
+	}
+	return records
+}
+
+// recordFrames returns the records as frames with the layout of the options.
+func recordFrames(topic string, records []record, opts FrameOptions) data.Frames {
+	if opts.Layout == "" || opts.Layout == FrameLayoutLong {
+		return data.Frames{select_fields(applyProfiles(recordsToFrame(topic, records), opts.Profiles), opts.Fields)}
+	}
+	return toLayoutFrames(topic, records, opts)
+}
@@ -0,0 +1,136 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinceLastUplink(t *testing.T) {
+	client := &fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"all": {
+				{Timestamp: time.Unix(100, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})},
+				{Timestamp: time.Unix(200, 0), Value: uplink(t, "tank-2", map[string]interface{}{"t": 2345})},
+				{Timestamp: time.Unix(250, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 3456})},
+			},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	res := ds.Query(backend.DataQuery{
+		JSON:      []byte(`{"queryText": "all", "layout": "perDevice", "sinceLastUplink": true}`),
+		TimeRange: backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(400, 0)},
+	})
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 2)
+
+	expected := map[string][]interface{}{
+		// 0 at each uplink, then the seconds since the last uplink at the end of the time range
+		"tank-1": {0.0, 0.0, 150.0},
+		"tank-2": {0.0, 200.0},
+	}
+	for _, frame := range res.Frames {
+		field := fieldByName(frame, "seconds_since_last_uplink")
+		require.NotNil(t, field)
+		values := make([]interface{}, field.Len())
+		for idx := range values {
+			values[idx], _ = field.ConcreteAt(idx)
+		}
+		require.Equal(t, expected[frame.Name], values, frame.Name)
+		require.Equal(t, time.Unix(400, 0), frame.Fields[0].At(field.Len()-1))
+	}
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	client := &fakeMQTTClient{
+		connected:  true,
+		subscribed: true,
+		streams:    mqtt.NewSubscribers(10),
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+	sender := &fakePacketSender{packets: make(chan *backend.StreamPacket, 10)}
+
+	path := "all/" + base64.RawURLEncoding.EncodeToString([]byte(`{"queryText": "all", "sinceLastUplink": true, "heartbeat": 1}`))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(sender))
+	}()
+
+	require.Eventually(t, func() bool { return client.streams.Count("all") == 1 }, time.Second, time.Millisecond)
+	client.streams.Publish(mqtt.StreamMessage{Topic: "all", Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})})
+	require.True(t, hasSchema(t, sender.next(t)))
+
+	// no message arrives, but the stream sends the seconds since the last uplink
+	var heartbeat *backend.StreamPacket
+	select {
+	case heartbeat = <-sender.packets:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for heartbeat")
+	}
+	require.False(t, hasSchema(t, heartbeat))
+
+	var frame struct {
+		Data struct {
+			Values [][]interface{} `json:"values"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(heartbeat.Data, &frame))
+	// Time, seconds_since_last_uplink, t
+	require.Len(t, frame.Data.Values, 3)
+	require.Greater(t, frame.Data.Values[1][0].(float64), 0.0)
+	require.Nil(t, frame.Data.Values[2][0])
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestStreamHeartbeatOfQuietDevice(t *testing.T) {
+	// the device went quiet an hour before the stream starts
+	client := &fakeMQTTClient{
+		connected:  true,
+		subscribed: true,
+		streams:    mqtt.NewSubscribers(10),
+		messages: map[string][]mqtt.Message{
+			"all": {{Timestamp: time.Now().Add(-time.Hour), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})}},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+	sender := &fakePacketSender{packets: make(chan *backend.StreamPacket, 10)}
+
+	path := "all/" + base64.RawURLEncoding.EncodeToString([]byte(`{"queryText": "all", "sinceLastUplink": true, "heartbeat": 1}`))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(sender))
+	}()
+
+	var heartbeat *backend.StreamPacket
+	select {
+	case heartbeat = <-sender.packets:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for heartbeat")
+	}
+
+	var frame struct {
+		Data struct {
+			Values [][]interface{} `json:"values"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(heartbeat.Data, &frame))
+	// Time, seconds_since_last_uplink
+	require.Len(t, frame.Data.Values, 2)
+	require.InDelta(t, 3600.0, frame.Data.Values[1][0].(float64), 5)
+
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// DecoderJavaScript runs a TTN style decodeUplink(input) payload formatter.
+const DecoderJavaScript = "javascript"
+
+// defaultScriptTimeout limits the run time of a payload formatter for one uplink.
+const defaultScriptTimeout = 100 * time.Millisecond
+
+// scriptError is an error of a payload formatter, reported as a frame notice.
+type scriptError struct {
+	msg string
+}
+
+func (e *scriptError) Error() string {
+	return "decodeUplink: " + e.msg
+}
+
+// javaScriptDecoder is a compiled payload formatter. The program is shared, but each
+// query runs it in its own runtime, since runtimes are not safe for concurrent use.
+type javaScriptDecoder struct {
+	program *goja.Program
+	timeout time.Duration
+}
+
+// javaScriptRuntime is a runtime that ran the program of a payload formatter once,
+// to call its decodeUplink for each uplink. It's created on the first uplink.
+type javaScriptRuntime struct {
+	vm           *goja.Runtime
+	decodeUplink goja.Callable
+	err          error
+}
+
+// withJavaScriptRuntimes returns a copy of the rules with a runtime for each javascript
+// rule, so the uplinks of a query share the runtime. The copy is not safe for concurrent use.
+func withJavaScriptRuntimes(rules []DecoderRule) []DecoderRule {
+	copied := make([]DecoderRule, len(rules))
+	copy(copied, rules)
+	for idx := range copied {
+		if copied[idx].javaScript != nil {
+			copied[idx].runtime = &javaScriptRuntime{}
+		}
+	}
+	return copied
+}
+
+// newJavaScriptDecoder compiles the payload formatter, which must define decodeUplink.
+func newJavaScriptDecoder(script string, timeout time.Duration) (*javaScriptDecoder, error) {
+	if !strings.Contains(script, "decodeUplink") {
+		return nil, errors.New("script doesn't define decodeUplink")
+	}
+	program, err := goja.Compile("decodeUplink.js", script, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid script: %w", err)
+	}
+	if timeout <= 0 {
+		timeout = defaultScriptTimeout
+	}
+	return &javaScriptDecoder{program: program, timeout: timeout}, nil
+}
+
+// init runs the program in a new runtime and looks up decodeUplink, once. The error
+// is kept, so the following uplinks fail the same way without running it again.
+func (d *javaScriptDecoder) init(rt *javaScriptRuntime) error {
+	if rt.vm != nil || rt.err != nil {
+		return rt.err
+	}
+	rt.vm = goja.New()
+	rt.vm.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+
+	stop := d.interruptAfter(rt.vm)
+	_, err := rt.vm.RunProgram(d.program)
+	stop()
+	if err != nil {
+		rt.err = &scriptError{msg: scriptErrorMessage(err)}
+		return rt.err
+	}
+	decodeUplink, ok := goja.AssertFunction(rt.vm.Get("decodeUplink"))
+	if !ok {
+		rt.err = &scriptError{msg: "decodeUplink is not a function"}
+		return rt.err
+	}
+	rt.decodeUplink = decodeUplink
+	return nil
+}
+
+// interruptAfter interrupts the runtime after the timeout. The returned function stops
+// the timer and clears an interrupt, so the runtime can run the next uplink.
+func (d *javaScriptDecoder) interruptAfter(vm *goja.Runtime) func() {
+	fired := make(chan struct{})
+	timer := time.AfterFunc(d.timeout, func() {
+		vm.Interrupt(fmt.Sprintf("timeout after %s", d.timeout))
+		close(fired)
+	})
+	return func() {
+		if !timer.Stop() {
+			<-fired
+		}
+		vm.ClearInterrupt()
+	}
+}
+
+// decode runs decodeUplink({bytes, fPort, recvTime}) in the runtime and returns the data
+// of the result, with nested objects flattened into fields joined by underscores, and the
+// warnings. Without a runtime, a new one is used for the uplink. The errors of the result,
+// exceptions and timeouts are returned as a scriptError.
+func (d *javaScriptDecoder) decode(rt *javaScriptRuntime, payload []byte, fPort uint64, recvTime time.Time) (map[string]interface{}, []string, error) {
+	if rt == nil {
+		rt = &javaScriptRuntime{}
+	}
+	if err := d.init(rt); err != nil {
+		return nil, nil, err
+	}
+	vm := rt.vm
+	stop := d.interruptAfter(vm)
+	defer stop()
+
+	bytes := make([]interface{}, len(payload))
+	for idx, b := range payload {
+		bytes[idx] = int64(b)
+	}
+	recv, err := vm.New(vm.Get("Date"), vm.ToValue(recvTime.UnixNano()/int64(time.Millisecond)))
+	if err != nil {
+		return nil, nil, &scriptError{msg: scriptErrorMessage(err)}
+	}
+	input := vm.NewObject()
+	_ = input.Set("bytes", bytes)
+	_ = input.Set("fPort", int64(fPort))
+	_ = input.Set("recvTime", recv)
+
+	value, err := rt.decodeUplink(goja.Undefined(), input)
+	if err != nil {
+		return nil, nil, &scriptError{msg: scriptErrorMessage(err)}
+	}
+
+	var result struct {
+		Data     map[string]interface{} `json:"data"`
+		Warnings []string               `json:"warnings"`
+		Errors   []string               `json:"errors"`
+	}
+	if err := vm.ExportTo(value, &result); err != nil {
+		return nil, nil, &scriptError{msg: fmt.Sprintf("invalid result: %s", err.Error())}
+	}
+	if len(result.Errors) > 0 {
+		return nil, result.Warnings, &scriptError{msg: strings.Join(result.Errors, "; ")}
+	}
+	if result.Data == nil {
+		return nil, result.Warnings, &scriptError{msg: "result has no data"}
+	}
+
+	body := make(map[string]interface{}, len(result.Data))
+	flatten(body, "", result.Data)
+	return body, result.Warnings, nil
+}
+
+// scriptErrorMessage returns the message of a script exception or interrupt.
+func scriptErrorMessage(err error) string {
+	var exception *goja.Exception
+	if errors.As(err, &exception) {
+		return exception.Value().String()
+	}
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		return fmt.Sprint(interrupted.Value())
+	}
+	return err.Error()
+}
+
+// flatten copies the values into the body, naming the values of nested objects
+// by their path joined with underscores, e.g. gps_latitude. Numbers are float64,
+// since goja exports whole numbers as int64.
+func flatten(body map[string]interface{}, prefix string, values map[string]interface{}) {
+	for key, val := range values {
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		if nested, ok := val.(map[string]interface{}); ok {
+			flatten(body, key, nested)
+			continue
+		}
+		body[key] = normalize(val)
+	}
+}
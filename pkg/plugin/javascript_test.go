@@ -0,0 +1,146 @@
+package plugin_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJavaScriptDecoder(t *testing.T) {
+	rules := func(t *testing.T, script string, timeout int) []plugin.DecoderRule {
+		rule, err := json.Marshal(map[string]interface{}{"decoder": "javascript", "script": script, "timeout": timeout})
+		require.NoError(t, err)
+		var decoders []plugin.DecoderRule
+		require.NoError(t, json.Unmarshal([]byte("["+string(rule)+"]"), &decoders))
+		return decoders
+	}
+
+	script := `
+		function decodeUplink(input) {
+			if (input.bytes.length < 3) {
+				return { errors: ["payload too short"] };
+			}
+			var warnings = [];
+			if (input.bytes[2] > 100) {
+				warnings.push("level out of range");
+			}
+			return {
+				data: {
+					temperature: ((input.bytes[0] << 8) | input.bytes[1]) / 100,
+					port: input.fPort,
+					battery: { low: input.bytes[2] < 10, level: input.bytes[2] },
+				},
+				warnings: warnings,
+			};
+		}`
+	messages := []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: rawUplink("tank-1", "0000000000000001", 2, []byte{0x09, 0x29, 0x50}, "")},
+		{Timestamp: time.Unix(2, 0), Value: rawUplink("tank-1", "0000000000000001", 2, []byte{0x09, 0x29}, "")},
+		{Timestamp: time.Unix(3, 0), Value: rawUplink("tank-1", "0000000000000001", 2, []byte{0x09, 0x29, 0xFF}, "")},
+		{Timestamp: time.Unix(4, 0), Value: rawUplink("tank-1", "0000000000000001", 2, []byte{0x09}, "")},
+	}
+
+	t.Run("decodeUplink", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Decoders: rules(t, script, 0)})
+		require.Len(t, frames, 1)
+		frame := frames[0]
+		require.Equal(t, []string{"Time", "battery_level", "battery_low", "port", "temperature"}, fieldNames(frame))
+		require.Equal(t, 2, frame.Rows())
+
+		temperature, ok := frame.Fields[4].ConcreteAt(0)
+		require.True(t, ok)
+		require.Equal(t, 23.45, temperature)
+		level, ok := frame.Fields[1].ConcreteAt(1)
+		require.True(t, ok)
+		require.Equal(t, 255.0, level)
+
+		require.Equal(t, []data.Notice{
+			{Severity: data.NoticeSeverityError, Text: "decodeUplink: payload too short (2 messages)"},
+			{Severity: data.NoticeSeverityWarning, Text: "decodeUplink: level out of range"},
+		}, frame.Meta.Notices)
+	})
+
+	t.Run("whole numbers", func(t *testing.T) {
+		// goja exports 23.45 as float64 and 23 as int64
+		frames := plugin.ToFrames("all", messages[:2], plugin.FrameOptions{
+			Decoders: rules(t, `function decodeUplink(input) {
+				return { data: { temperature: input.bytes.length == 3 ? 23.45 : 23 } };
+			}`, 0),
+		})
+		require.Len(t, frames, 1)
+		field := fieldByName(frames[0], "temperature")
+		require.NotNil(t, field)
+		require.Equal(t, 2, field.Len())
+		for idx, expected := range []float64{23.45, 23} {
+			val, ok := field.ConcreteAt(idx)
+			require.True(t, ok)
+			require.Equal(t, expected, val)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages[:1], plugin.FrameOptions{
+			Decoders: rules(t, `function decodeUplink(input) { while (true) {} }`, 10),
+		})
+		require.Len(t, frames, 1)
+		require.Equal(t, []data.Notice{
+			{Severity: data.NoticeSeverityError, Text: "decodeUplink: timeout after 10ms"},
+		}, frames[0].Meta.Notices)
+	})
+
+	t.Run("runtime shared by the uplinks of a query", func(t *testing.T) {
+		decoders := rules(t, `
+			var runs = 0;
+			function decodeUplink(input) {
+				if (input.bytes.length == 2) { while (true) {} }
+				runs++;
+				return { data: { runs: runs } };
+			}`, 10)
+		frames := plugin.ToFrames("all", messages[:3], plugin.FrameOptions{Decoders: decoders})
+		require.Len(t, frames, 1)
+		field := fieldByName(frames[0], "runs")
+		require.NotNil(t, field)
+		// the uplink after the timeout runs in the same runtime
+		require.Equal(t, 2, field.Len())
+		for idx, expected := range []float64{1, 2} {
+			val, ok := field.ConcreteAt(idx)
+			require.True(t, ok)
+			require.Equal(t, expected, val)
+		}
+		require.Equal(t, []data.Notice{
+			{Severity: data.NoticeSeverityError, Text: "decodeUplink: timeout after 10ms"},
+		}, frames[0].Meta.Notices)
+
+		// the next query starts with a new runtime
+		frames = plugin.ToFrames("all", messages[:1], plugin.FrameOptions{Decoders: decoders})
+		val, ok := fieldByName(frames[0], "runs").ConcreteAt(0)
+		require.True(t, ok)
+		require.Equal(t, 1.0, val)
+	})
+
+	t.Run("exception", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages[:1], plugin.FrameOptions{
+			Decoders: rules(t, `function decodeUplink(input) { throw new Error("bad payload"); }`, 0),
+		})
+		require.Len(t, frames, 1)
+		require.Equal(t, "decodeUplink: Error: bad payload", frames[0].Meta.Notices[0].Text)
+	})
+
+	t.Run("invalid script", func(t *testing.T) {
+		for _, script := range []string{`function decodeUplink(input) {`, `function decode(input) {}`} {
+			var decoders []plugin.DecoderRule
+			require.Error(t, json.Unmarshal([]byte(`[{"decoder": "javascript", "script": `+mustJSON(t, script)+`}]`), &decoders))
+		}
+	})
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
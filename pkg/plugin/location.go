@@ -0,0 +1,231 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+)
+
+// sourcePayload is the source of a location decoded from the uplink payload.
+const sourcePayload = "SOURCE_PAYLOAD"
+
+// ttnLocation is a location at The Things Network, e.g. of a device or gateway.
+type ttnLocation struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude"`
+	Accuracy  *float64 `json:"accuracy"`
+	Source    string   `json:"source"`
+}
+
+// ttnLocationSolved is a message published to location/solved by a geolocation service.
+type ttnLocationSolved struct {
+	EndDeviceIDs   ttnEndDeviceIDs `json:"end_device_ids"`
+	ReceivedAt     time.Time       `json:"received_at"`
+	LocationSolved *struct {
+		Service  string      `json:"service"`
+		Location ttnLocation `json:"location"`
+	} `json:"location_solved"`
+}
+
+// locationSources orders the locations in the uplink metadata, the first one found is used.
+var locationSources = []string{"frm-payload", "user"}
+
+// deviceLocation is the last location of a device or gateway.
+type deviceLocation struct {
+	timestamp time.Time
+	id        string
+	eui       string
+	location  ttnLocation
+}
+
+// locations keeps the last location of each device or gateway.
+type locations map[string]*deviceLocation
+
+// add updates the location of the device, unless a later location is known.
+func (l locations) add(timestamp time.Time, id, eui string, location ttnLocation) {
+	if id == "" {
+		return
+	}
+	if last, ok := l[id]; ok && timestamp.Before(last.timestamp) {
+		return
+	}
+	l[id] = &deviceLocation{timestamp: timestamp, id: id, eui: eui, location: location}
+}
+
+// sorted returns the locations ordered by ID.
+func (l locations) sorted() []*deviceLocation {
+	list := make([]*deviceLocation, 0, len(l))
+	for _, loc := range l {
+		list = append(list, loc)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].id < list[j].id
+	})
+	return list
+}
+
+// payloadLocation returns the location in the decoded fields: latitude and longitude,
+// lat and lon (or lng), or the fields of a Cayenne LPP GPS, e.g. gps_1_latitude.
+func payloadLocation(body map[string]interface{}) (ttnLocation, bool) {
+	number := func(key string) (float64, bool) {
+		val, ok := normalize(body[key]).(float64)
+		return val, ok
+	}
+	prefixes := []string{""}
+	keys := make([]string, 0, len(body))
+	for key := range body {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.HasSuffix(key, "_latitude") {
+			prefixes = append(prefixes, strings.TrimSuffix(key, "latitude"))
+		}
+	}
+
+	for _, prefix := range prefixes {
+		for _, names := range [][3]string{{"latitude", "longitude", "altitude"}, {"lat", "lon", "alt"}, {"lat", "lng", "alt"}} {
+			lat, ok := number(prefix + names[0])
+			if !ok {
+				continue
+			}
+			lon, ok := number(prefix + names[1])
+			if !ok {
+				continue
+			}
+			location := ttnLocation{Latitude: lat, Longitude: lon, Source: sourcePayload}
+			if alt, ok := number(prefix + names[2]); ok {
+				location.Altitude = &alt
+			}
+			return location, true
+		}
+	}
+	return ttnLocation{}, false
+}
+
+// uplinkLocation returns the location of the device sending the uplink: the location
+// decoded from the payload, or else the location in the uplink metadata.
+func uplinkLocation(r record) (ttnLocation, bool) {
+	if location, ok := payloadLocation(r.body); ok {
+		return location, true
+	}
+	metadata := r.uplink.UplinkMessage.Locations
+	for _, source := range locationSources {
+		if location, ok := metadata[source]; ok {
+			return location, true
+		}
+	}
+	// other sources, in a stable order
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return ttnLocation{}, false
+	}
+	sort.Strings(keys)
+	return metadata[keys[0]], true
+}
+
+// deviceLocations returns the last location of each device in the time range, from
+// the decoded uplinks and the locations solved by geolocation services.
+func deviceLocations(records []record, solved []mqtt.Message, tr backend.TimeRange) locations {
+	devices := make(locations)
+	for _, r := range records {
+		if !inTimeRange(r.timestamp, tr) {
+			continue
+		}
+		if location, ok := uplinkLocation(r); ok {
+			devices.add(r.timestamp, r.labels["device_id"], r.labels["dev_eui"], location)
+		}
+	}
+
+	for _, m := range solved {
+		var event ttnLocationSolved
+		if err := json.Unmarshal([]byte(m.Value), &event); err != nil {
+			log.DefaultLogger.Debug(fmt.Sprintf("deviceLocations: Decode error %s", err.Error()))
+			continue
+		}
+		if event.LocationSolved == nil {
+			continue
+		}
+		timestamp := m.Timestamp
+		if !event.ReceivedAt.IsZero() {
+			timestamp = event.ReceivedAt
+		}
+		if !inTimeRange(timestamp, tr) {
+			continue
+		}
+		devices.add(timestamp, event.EndDeviceIDs.DeviceID, event.EndDeviceIDs.DevEUI, event.LocationSolved.Location)
+	}
+	return devices
+}
+
+// gatewayLocations returns the last location of each gateway that received
+// the uplinks in the time range.
+func gatewayLocations(records []record, tr backend.TimeRange) locations {
+	gateways := make(locations)
+	for _, r := range records {
+		if !inTimeRange(r.timestamp, tr) {
+			continue
+		}
+		for _, rx := range r.uplink.UplinkMessage.RxMetadata {
+			if rx.Location != nil {
+				gateways.add(r.timestamp, rx.GatewayIDs.GatewayID, rx.GatewayIDs.EUI, *rx.Location)
+			}
+		}
+	}
+	return gateways
+}
+
+// locationFrame returns a frame for the Geomap panel, with one row per device or gateway:
+// the time of the location, the ID (device_id or gateway_id) and EUI (dev_eui or eui),
+// and the latitude, longitude, altitude, accuracy and source of the location.
+func locationFrame(name, idName, euiName string, l locations) *data.Frame {
+	list := l.sorted()
+
+	count := len(list)
+	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, count)
+	timeField.Name = "Time"
+	idField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	idField.Name = idName
+	euiField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	euiField.Name = euiName
+	latField := data.NewFieldFromFieldType(data.FieldTypeFloat64, count)
+	latField.Name = "latitude"
+	lonField := data.NewFieldFromFieldType(data.FieldTypeFloat64, count)
+	lonField.Name = "longitude"
+	altField := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, count)
+	altField.Name = "altitude"
+	altField.Config = &data.FieldConfig{Unit: "lengthm"}
+	accuracyField := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, count)
+	accuracyField.Name = "accuracy"
+	accuracyField.Config = &data.FieldConfig{Unit: "lengthm"}
+	sourceField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	sourceField.Name = "source"
+
+	for row, loc := range list {
+		timeField.Set(row, loc.timestamp)
+		idField.Set(row, loc.id)
+		euiField.Set(row, loc.eui)
+		latField.Set(row, loc.location.Latitude)
+		lonField.Set(row, loc.location.Longitude)
+		if loc.location.Altitude != nil {
+			altField.SetConcrete(row, *loc.location.Altitude)
+		}
+		if loc.location.Accuracy != nil {
+			accuracyField.SetConcrete(row, *loc.location.Accuracy)
+		}
+		sourceField.Set(row, loc.location.Source)
+	}
+
+	return data.NewFrame(name, timeField, idField, euiField, latField, lonField, altField, accuracyField, sourceField)
+}
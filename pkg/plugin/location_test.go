@@ -0,0 +1,91 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocations(t *testing.T) {
+	client := &fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"all": {
+				// decoded from the payload, the later one wins
+				{Timestamp: time.Unix(100, 0), Value: uplink(t, "tank-1", map[string]interface{}{"lat": 1.0, "lon": 2.0})},
+				{Timestamp: time.Unix(200, 0), Value: uplink(t, "tank-1", map[string]interface{}{"gps_1_latitude": 1.5, "gps_1_longitude": 2.5, "gps_1_altitude": 30.0})},
+				// no location
+				{Timestamp: time.Unix(200, 0), Value: uplink(t, "tank-2", map[string]interface{}{"t": 1234})},
+				// location in the uplink metadata, and of the gateways
+				{Timestamp: time.Unix(300, 0), Value: `{
+					"end_device_ids": {"device_id": "tank-3", "dev_eui": "70B3D57ED0000003"},
+					"uplink_message": {
+						"frm_payload": "oWF0GQTS",
+						"locations": {"user": {"latitude": 3, "longitude": 4, "altitude": 10, "source": "SOURCE_REGISTRY"}},
+						"rx_metadata": [
+							{"gateway_ids": {"gateway_id": "luppy-wisgate-rak7248", "eui": "B827EBFFFE000001"}, "location": {"latitude": 5, "longitude": 6, "source": "SOURCE_REGISTRY"}},
+							{"gateway_ids": {"gateway_id": "other-gateway"}}
+						]
+					}
+				}`},
+				// out of the time range
+				{Timestamp: time.Unix(2000, 0), Value: uplink(t, "tank-2", map[string]interface{}{"latitude": 9.0, "longitude": 9.0})},
+			},
+			"locations": {
+				{Timestamp: time.Unix(400, 0), Value: `{
+					"end_device_ids": {"device_id": "tank-3", "dev_eui": "70B3D57ED0000003"},
+					"location_solved": {"service": "lora-cloud-geolocation", "location": {"latitude": 3.5, "longitude": 4.5, "accuracy": 120, "source": "SOURCE_LORA_RSSI_GEOLOCATION"}}
+				}`},
+			},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	query := func(json string) backend.DataResponse {
+		return ds.Query(backend.DataQuery{
+			QueryType: "locations",
+			JSON:      []byte(json),
+			TimeRange: backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(1000, 0)},
+		})
+	}
+
+	res := query(`{}`)
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 1)
+
+	devices := res.Frames[0]
+	require.Equal(t, 2, devices.Rows())
+	column := func(name string) []interface{} {
+		field := fieldByName(devices, name)
+		require.NotNil(t, field, name)
+		values := make([]interface{}, field.Len())
+		for idx := range values {
+			if val, ok := field.ConcreteAt(idx); ok {
+				values[idx] = val
+			}
+		}
+		return values
+	}
+	require.Equal(t, []interface{}{"tank-1", "tank-3"}, column("device_id"))
+	require.Equal(t, []interface{}{int64(200), int64(400)}, unix(column("Time")))
+	require.Equal(t, []interface{}{1.5, 3.5}, column("latitude"))
+	require.Equal(t, []interface{}{2.5, 4.5}, column("longitude"))
+	require.Equal(t, []interface{}{30.0, nil}, column("altitude"))
+	require.Equal(t, []interface{}{nil, 120.0}, column("accuracy"))
+	require.Equal(t, []interface{}{"SOURCE_PAYLOAD", "SOURCE_LORA_RSSI_GEOLOCATION"}, column("source"))
+
+	res = query(`{"gateways": true}`)
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 2)
+
+	gateways := res.Frames[1]
+	require.Equal(t, 1, gateways.Rows())
+	require.Equal(t, "luppy-wisgate-rak7248", fieldByName(gateways, "gateway_id").At(0))
+	require.Equal(t, "B827EBFFFE000001", fieldByName(gateways, "eui").At(0))
+	require.Equal(t, 5.0, fieldByName(gateways, "latitude").At(0))
+	require.Equal(t, 6.0, fieldByName(gateways, "longitude").At(0))
+}
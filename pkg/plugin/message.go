@@ -23,7 +23,7 @@ func ToFrame(topic string, messages []mqtt.Message) *data.Frame {
 	if count > 0 {
 		first := messages[0].Value
 		if strings.HasPrefix(first, "{") {
-			return jsonMessagesToFrame(topic, messages)
+			return jsonMessagesToFrame(topic, messages, FrameOptions{})
 		}
 	}
 
@@ -43,117 +43,440 @@ func ToFrame(topic string, messages []mqtt.Message) *data.Frame {
 	return data.NewFrame(topic, timeField, valueField)
 }
 
+//  Layout of the Data Frames for messages received from multiple devices
+type FrameLayout string
+
+const (
+	//  Single Data Frame (default). Device identity is attached as labels when
+	//  all messages come from one device, otherwise as columns.
+	FrameLayoutLong FrameLayout = "long"
+
+	//  One Data Frame per device
+	FrameLayoutPerDevice FrameLayout = "perDevice"
+
+	//  Single Data Frame with one field per device and key, labelled by device identity
+	FrameLayoutWide FrameLayout = "wide"
+)
+
+//  Field to include in the Data Frames, with an optional alias and unit
+type FieldSelection struct {
+	Name  string `json:"name"`
+	Alias string `json:"alias,omitempty"`
+	Unit  string `json:"unit,omitempty"`
+}
+
+//  Options for transforming MQTT Messages into Data Frames
+type FrameOptions struct {
+	Layout FrameLayout
+
+	//  Fields to include, in order. All fields are included if empty.
+	Fields []FieldSelection
+
+	//  Fields computed from the decoded fields. Always included, even if not selected.
+	Computed []ComputedField
+
+	//  Records to include. All records are included if nil.
+	Filter *Filter
+
+	//  Decoders of the payloads and display metadata of the decoded fields, from the datasource settings
+	Decoders []DecoderRule
+	Profiles []DeviceProfile
+
+	//  Downsample the records into buckets of the Interval. No aggregation if nil or the Interval is 0.
+	Aggregation *Aggregation
+	Interval    time.Duration
+
+	//  Add seconds_since_last_uplink to the records, 0 at each uplink. If Now is set, each device
+	//  also gets a row at Now with the seconds since its last uplink, so silence shows in the panel.
+	SinceLastUplink bool
+	Now             time.Time
+}
+
+//  Transform the array of MQTT Messages into Data Frames with the requested layout
+func ToFrames(topic string, messages []mqtt.Message, opts FrameOptions) data.Frames {
+	log.DefaultLogger.Debug(fmt.Sprintf("ToFrames: topic=%s, layout=%s", topic, opts.Layout))
+
+	//  Values are returned as a single Data Frame
+	if len(messages) == 0 || !strings.HasPrefix(messages[0].Value, "{") {
+		return data.Frames{select_fields(ToFrame(topic, messages), opts.Fields)}
+	}
+
+	//  The long layout is returned as a single Data Frame
+	if opts.Layout == "" || opts.Layout == FrameLayoutLong {
+		return data.Frames{jsonMessagesToFrame(topic, messages, opts)}
+	}
+
+	//  Decode the payloads, then filter, select and aggregate the records
+	records, notices, err := decodeMessagesWithNotices(messages, opts.Decoders)
+	if err != nil {
+		return data.Frames{decode_error_frame(topic, err, notices)}
+	}
+	records = apply_options(records, opts)
+	frames := toLayoutFrames(topic, records, opts)
+	if len(notices) > 0 {
+		//  Keep the notices even if no device has records
+		if len(frames) == 0 {
+			frames = data.Frames{data.NewFrame(topic)}
+		}
+		set_notices(frames[0], notices)
+	}
+	return frames
+}
+
+//  Transform the decoded records into Data Frames with the requested layout, other than long
+func toLayoutFrames(topic string, records []record, opts FrameOptions) data.Frames {
+	switch opts.Layout {
+	case FrameLayoutPerDevice:
+		//  One Data Frame per device, named after the device
+		devices, groups := groupByDevice(records)
+		frames := make(data.Frames, 0, len(devices))
+		for _, device := range devices {
+			frames = append(frames, select_fields(applyProfiles(recordsToFrame(device, groups[device]), opts.Profiles), opts.Fields))
+		}
+		return frames
+
+	case FrameLayoutWide:
+		return data.Frames{select_fields(applyProfiles(recordsToWideFrame(topic, records), opts.Profiles), opts.Fields)}
+
+	default:
+		return data.Frames{set_error(data.NewFrame(topic), fmt.Errorf("unknown layout: %s", opts.Layout))}
+	}
+}
+
+//  MQTT Message decoded into a map of fields and the labels identifying the device
+type record struct {
+	timestamp time.Time
+	body      map[string]interface{}
+	labels    data.Labels
+	uplink    ttnUplink
+}
+
+//  Metadata of the Uplink Message at The Things Network.
+//  See sample messages: https://github.com/lupyuen/the-things-network-datasource#mqtt-log
+type ttnUplink struct {
+	EndDeviceIDs  ttnEndDeviceIDs `json:"end_device_ids"`
+	UplinkMessage struct {
+		SessionKeyID string                 `json:"session_key_id"`
+		FCnt         uint64                 `json:"f_cnt"`
+		FPort        uint64                 `json:"f_port"`
+		RxMetadata   []ttnRxMetadata        `json:"rx_metadata"`
+		Locations    map[string]ttnLocation `json:"locations"`
+	} `json:"uplink_message"`
+}
+
+//  Identifiers of the device that sent the message. DevAddr is only set after a join.
+type ttnEndDeviceIDs struct {
+	DeviceID string `json:"device_id"`
+	DevEUI   string `json:"dev_eui"`
+	JoinEUI  string `json:"join_eui"`
+	DevAddr  string `json:"dev_addr"`
+}
+
+//  Metadata of a Gateway that received the Uplink Message
+type ttnRxMetadata struct {
+	GatewayIDs struct {
+		GatewayID string `json:"gateway_id"`
+		EUI       string `json:"eui"`
+	} `json:"gateway_ids"`
+	Location *ttnLocation `json:"location"`
+}
+
 //  Transform the array of MQTT Messages (JSON encoded) into a Grafana Data Frame.
+//  Only the matching records and the selected fields are included.
 //  See sample messages: https://github.com/lupyuen/the-things-network-datasource#mqtt-log
-func jsonMessagesToFrame(topic string, messages []mqtt.Message) *data.Frame {
+func jsonMessagesToFrame(topic string, messages []mqtt.Message, opts FrameOptions) *data.Frame {
 	//  Quit if no messages to transform
 	count := len(messages)
 	if count == 0 {
 		log.DefaultLogger.Debug(fmt.Sprintf("jsonMessagesToFrame: No msgs for topic=%s", topic))
 		return nil
 	}
+	log.DefaultLogger.Debug(fmt.Sprintf("jsonMessagesToFrame: topic=%s, msg=%s", topic, messages[0].Value))
 
-	//  Transform the first message
-	msg := messages[0]
-	log.DefaultLogger.Debug(fmt.Sprintf("jsonMessagesToFrame: topic=%s, msg=%s", topic, msg.Value))
-
-	//  Decode the CBOR payload
-	body, err := decodeCborPayload(msg.Value)
+	//  Decode the payloads. Errors of the payload formatters are returned as notices.
+	records, notices, err := decodeMessagesWithNotices(messages, opts.Decoders)
 	if err != nil {
-		return set_error(data.NewFrame(topic), err)
+		return decode_error_frame(topic, err, notices)
 	}
 
-	//  Construct the Timestamp field
-	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, count)
-	timeField.Name = "Time"
-	timeField.SetConcrete(0, msg.Timestamp)
+	//  Construct the Data Frame with the matching records and selected fields
+	records = apply_options(records, opts)
+	frame := select_fields(applyProfiles(recordsToFrame(topic, records), opts.Profiles), opts.Fields)
+	set_notices(frame, notices)
 
-	//  Create a field for each key and set the first value
-	keys := make([]string, 0, len(body))
-	fields := make(map[string]*data.Field, len(body))
+	//  Dump the Data Frame
+	log.DefaultLogger.Debug(fmt.Sprintf("jsonMessagesToFrame: Frame=%+v", frame))
+	for _, field := range frame.Fields {
+		log.DefaultLogger.Debug(fmt.Sprintf("  field=%+v", field))
+	}
+	return frame
+}
 
-	//  Compose the fields for the first row of the Data Frame
-	for key, val := range body {
-		//  Get the Data Frame Type for the field
-		typ := get_type(val)
+//  Decode the payloads of the MQTT Messages with the decoder rules. Messages that can't be decoded
+//  are skipped. Returns an error if none of the messages could be decoded.
+func decodeMessages(messages []mqtt.Message, decoders []DecoderRule) ([]record, error) {
+	records, _, err := decodeMessagesWithNotices(messages, decoders)
+	return records, err
+}
 
-		//  Create the field for the first row
-		field := data.NewFieldFromFieldType(typ, count)
-		field.Name = key
-		field.SetConcrete(0, val)
-		fields[key] = field
-		keys = append(keys, key)
+//  Decode the payloads of the MQTT Messages like decodeMessages, and return the errors and warnings
+//  of the payload formatters as notices, with the number of messages for each.
+func decodeMessagesWithNotices(messages []mqtt.Message, decoders []DecoderRule) ([]record, []data.Notice, error) {
+	var lastErr error
+	var notices noticeCounter
+	records := make([]record, 0, len(messages))
+	decoders = withJavaScriptRuntimes(decoders)
+	for _, m := range messages {
+		body, labels, warnings, err := decodePayload(m.Value, decoders)
+		for _, warning := range warnings {
+			notices.add(data.NoticeSeverityWarning, "decodeUplink: "+warning)
+		}
+		if err != nil {
+			log.DefaultLogger.Debug(fmt.Sprintf("decodeMessages: Decode error %s", err.Error()))
+			var script_err *scriptError
+			if errors.As(err, &script_err) {
+				notices.add(data.NoticeSeverityError, script_err.Error())
+			}
+			lastErr = err
+			continue
+		}
+		//  Decode the Uplink metadata. Plain JSON messages have none.
+		var uplink ttnUplink
+		if labels != nil {
+			if err := json.Unmarshal([]byte(m.Value), &uplink); err != nil {
+				log.DefaultLogger.Debug(fmt.Sprintf("decodeMessages: Metadata error %s", err.Error()))
+			}
+		}
+		records = append(records, record{timestamp: m.Timestamp, body: body, labels: labels, uplink: uplink})
 	}
-	sort.Strings(keys) // keys stable field order.
+	if len(records) == 0 && lastErr != nil {
+		return nil, notices.list(), lastErr
+	}
+	return records, notices.list(), nil
+}
 
-	//  Transform the messages after the first one
-	for row, m := range messages {
-		//  Skip the first message
-		if row == 0 {
-			continue
+//  Count the notices by severity and text, in order of first occurrence
+type noticeCounter struct {
+	notices []data.Notice
+	counts  []int
+}
+
+func (c *noticeCounter) add(severity data.NoticeSeverity, text string) {
+	for idx, notice := range c.notices {
+		if notice.Severity == severity && notice.Text == text {
+			c.counts[idx]++
+			return
 		}
+	}
+	c.notices = append(c.notices, data.Notice{Severity: severity, Text: text})
+	c.counts = append(c.counts, 1)
+}
 
-		//  Decode the CBOR payload
-		body, err := decodeCborPayload(m.Value)
-		if err != nil {
-			log.DefaultLogger.Debug(fmt.Sprintf("jsonMessagesToFrame: Decode error %s", err.Error()))
-			continue
+//  Return the notices, with the number of messages if more than one
+func (c *noticeCounter) list() []data.Notice {
+	notices := make([]data.Notice, len(c.notices))
+	for idx, notice := range c.notices {
+		if c.counts[idx] > 1 {
+			notice.Text = fmt.Sprintf("%s (%d messages)", notice.Text, c.counts[idx])
 		}
+		notices[idx] = notice
+	}
+	return notices
+}
+
+//  Transform the decoded records into a Data Frame with a Time field and a field for each key.
+//  If the records come from a single device, the device labels are attached to the value fields.
+//  Otherwise each label becomes a column, since labels can't vary between rows of a field.
+func recordsToFrame(name string, records []record) *data.Frame {
+	count := len(records)
+	labels, same := commonLabels(records)
+
+	//  Construct the Timestamp field
+	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, count)
+	timeField.Name = "Time"
+
+	//  Create a field for each key, typed by the first value seen for the key
+	keys := make([]string, 0)
+	fields := make(map[string]*data.Field)
 
+	for row, r := range records {
 		//  Set the Timestamp for the transformed row
-		timeField.SetConcrete(row, m.Timestamp)
+		timeField.SetConcrete(row, r.timestamp)
 
 		//  Set the fields for the transformed row
+		body := r.body
+		if !same {
+			body = withLabels(r)
+		}
 		for key, val := range body {
 			field, ok := fields[key]
-			if ok {
-				field.SetConcrete(row, val)
+			if !ok {
+				field = new_field(key, val, count)
+				if field == nil {
+					continue
+				}
+				if same {
+					field.Labels = labels.Copy()
+				}
+				fields[key] = field
+				keys = append(keys, key)
 			}
+			set_value(field, row, val)
 		}
 	}
+	sort.Strings(keys) // keys stable field order.
 
 	//  Construct the Data Frame
-	frame := data.NewFrame(topic, timeField)
+	frame := data.NewFrame(name, timeField)
 
 	//  Append the fields to the Data Frame
 	for _, key := range keys {
 		frame.Fields = append(frame.Fields, fields[key])
 	}
+	return frame
+}
 
-	//  Dump the Data Frame
-	log.DefaultLogger.Debug(fmt.Sprintf("jsonMessagesToFrame: Frame=%+v", frame))
-	for _, field := range frame.Fields {
-		log.DefaultLogger.Debug(fmt.Sprintf("  field=%+v", field))
+//  Transform the decoded records into a wide Data Frame: one row per record and
+//  one field per device and key, labelled by the device labels. Rows from other devices are null.
+func recordsToWideFrame(name string, records []record) *data.Frame {
+	count := len(records)
+
+	//  Construct the Timestamp field
+	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, count)
+	timeField.Name = "Time"
+
+	//  Fields are identified by key and device labels
+	type wideKey struct {
+		key    string
+		device string
+	}
+	keys := make([]wideKey, 0)
+	fields := make(map[wideKey]*data.Field)
+
+	for row, r := range records {
+		timeField.SetConcrete(row, r.timestamp)
+
+		device := r.labels.String()
+		for key, val := range r.body {
+			k := wideKey{key: key, device: device}
+			field, ok := fields[k]
+			if !ok {
+				field = new_field(key, val, count)
+				if field == nil {
+					continue
+				}
+				field.Labels = r.labels.Copy()
+				fields[k] = field
+				keys = append(keys, k)
+			}
+			set_value(field, row, val)
+		}
+	}
+
+	//  Order the fields by key, then by device
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].key != keys[j].key {
+			return keys[i].key < keys[j].key
+		}
+		return keys[i].device < keys[j].device
+	})
+
+	frame := data.NewFrame(name, timeField)
+	for _, k := range keys {
+		frame.Fields = append(frame.Fields, fields[k])
 	}
 	return frame
 }
 
-//  Decode the CBOR payload in the JSON message.
+//  Group the records by device_id.
+//  Returns the sorted device IDs and the records for each device.
+func groupByDevice(records []record) ([]string, map[string][]record) {
+	devices := make([]string, 0)
+	groups := make(map[string][]record)
+	for _, r := range records {
+		device := r.labels["device_id"]
+		if _, ok := groups[device]; !ok {
+			devices = append(devices, device)
+		}
+		groups[device] = append(groups[device], r)
+	}
+	sort.Strings(devices)
+	return devices, groups
+}
+
+//  Return the labels shared by all records, and whether all records have the same labels
+func commonLabels(records []record) (data.Labels, bool) {
+	if len(records) == 0 {
+		return nil, true
+	}
+	labels := records[0].labels
+	for _, r := range records[1:] {
+		if !labels.Equals(r.labels) {
+			return nil, false
+		}
+	}
+	return labels, true
+}
+
+//  Return the body of the record with the device labels added as fields
+func withLabels(r record) map[string]interface{} {
+	body := make(map[string]interface{}, len(r.body)+len(r.labels))
+	for key, val := range r.body {
+		body[key] = val
+	}
+	for key, val := range r.labels {
+		body[key] = val
+	}
+	return body
+}
+
+//  Decode the payload in the JSON message with the decoder selected by the rules, CBOR by default.
+//  Returns the decoded fields, the labels identifying the device and the warnings of the decoder.
 //  See sample messages: https://github.com/lupyuen/the-things-network-datasource#mqtt-log
-func decodeCborPayload(msg string) (map[string]interface{}, error) {
+func decodePayload(msg string, decoders []DecoderRule) (map[string]interface{}, data.Labels, []string, error) {
 	//  Deserialise the message doc to a map of String -> interface{}
 	var doc map[string]interface{}
 	err := json.Unmarshal([]byte(msg), &doc)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+
+	//  Messages that don't come from The Things Network are plain JSON objects
+	_, has_uplink := doc["uplink_message"]
+	_, has_device := doc["end_device_ids"]
+	if !has_uplink && !has_device {
+		return doc, nil, nil, nil
 	}
 
 	//  Get the Uplink Message
 	uplink_message, ok := doc["uplink_message"].(map[string]interface{})
 	if !ok {
-		return nil, errors.New("uplink_message missing")
+		return nil, nil, nil, errors.New("uplink_message missing")
+	}
+
+	//  Decode with the first matching rule, unless it's CBOR
+	labels := device_labels(doc)
+	f_port, _ := uplink_message["f_port"].(float64)
+	rule := selectDecoder(decoders, uint64(f_port), labels["device_id"], labels["dev_eui"])
+	if rule != nil && rule.Decoder != DecoderCBOR {
+		body, warnings, err := rule.decode(uplink_message, uint64(f_port))
+		if err != nil {
+			return nil, nil, warnings, fmt.Errorf("%s decoder: %w", rule.Decoder, err)
+		}
+		log.DefaultLogger.Debug(fmt.Sprintf("%s decoded: %v", rule.Decoder, body))
+		return body, labels, warnings, nil
 	}
 
 	//  Get the Payload
 	frm_payload, ok := uplink_message["frm_payload"].(string)
 	if !ok {
-		return nil, errors.New("frm_payload missing")
+		return nil, nil, nil, errors.New("frm_payload missing")
 	}
 
 	//  Base64 decode the Payload
 	payload, err := base64.StdEncoding.DecodeString(frm_payload)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	log.DefaultLogger.Debug(fmt.Sprintf("payload: %v", payload))
 
@@ -167,16 +490,7 @@ func decodeCborPayload(msg string) (map[string]interface{}, error) {
 	var body map[string]interface{}
 	err = cbor.Unmarshal(payload, &body)
 	if err != nil {
-		return nil, err
-	}
-
-	//  Add the Device ID to the body: end_device_ids -> device_id
-	end_device_ids, ok := doc["end_device_ids"].(map[string]interface{})
-	if ok {
-		device_id, ok := end_device_ids["device_id"].(string)
-		if ok {
-			body["device_id"] = device_id
-		}
+		return nil, nil, nil, err
 	}
 
 	//  TODO: Test various field types
@@ -184,28 +498,43 @@ func decodeCborPayload(msg string) (map[string]interface{}, error) {
 	//  body["u64"] = uint64(1234)
 	//  body["str"] = "Test"
 
-	//  Shows: map[device_id:eui-70b3d57ed0045669 t:1234]
+	//  Shows: map[t:1234]
 	log.DefaultLogger.Debug(fmt.Sprintf("CBOR decoded: %v", body))
-	return body, nil
+	return body, labels, nil, nil
 }
 
-//  Return the Data Frame Type for the CBOR decoded value
+//  Return the labels identifying the device that sent the message:
+//  end_device_ids -> device_id, dev_eui, join_eui and application_ids -> application_id
+func device_labels(doc map[string]interface{}) data.Labels {
+	end_device_ids, ok := doc["end_device_ids"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	labels := data.Labels{}
+	for _, key := range []string{"device_id", "dev_eui", "join_eui"} {
+		if val, ok := end_device_ids[key].(string); ok && val != "" {
+			labels[key] = val
+		}
+	}
+	if application_ids, ok := end_device_ids["application_ids"].(map[string]interface{}); ok {
+		if val, ok := application_ids["application_id"].(string); ok && val != "" {
+			labels["application_id"] = val
+		}
+	}
+	return labels
+}
+
+//  Return the Data Frame Type for the CBOR decoded value.
+//  All numbers are float64, since a key may decode to uint64, int64 or float64 in different uplinks.
 func get_type(val interface{}) data.FieldType {
 	//  Based on https://github.com/fxamacker/cbor/blob/master/decode.go#L43-L53
-	switch v := val.(type) {
+	switch v := normalize(val).(type) {
 	//  CBOR booleans decode to bool.
 	case bool:
 		return data.FieldTypeBool
 
-	//  CBOR positive integers decode to uint64.
-	case uint64:
-		return data.FieldTypeNullableUint64
-
-	//  CBOR negative integers decode to int64 (big.Int if value overflows).
-	case int64:
-		return data.FieldTypeInt64
-
-	//  CBOR floating points decode to float64.
+	//  CBOR positive integers decode to uint64, negative integers to int64 (big.Int if value
+	//  overflows) and floating points to float64. All are normalized to float64.
 	case float64:
 		return data.FieldTypeNullableFloat64
 
@@ -228,6 +557,140 @@ func get_type(val interface{}) data.FieldType {
 	}
 }
 
+//  Create a nullable field for the key, typed by the CBOR decoded value.
+//  Returns nil if the value has an unknown type.
+func new_field(key string, val interface{}, count int) *data.Field {
+	typ := get_type(val)
+	if typ == data.FieldTypeUnknown {
+		return nil
+	}
+	field := data.NewFieldFromFieldType(typ.NullableType(), count)
+	field.Name = key
+	return field
+}
+
+//  Set the value of the field at the row. Numbers are set as float64,
+//  other values that don't match the field type are skipped.
+func set_value(field *data.Field, row int, val interface{}) {
+	val = normalize(val)
+	if get_type(val).NullableType() != field.Type().NullableType() {
+		log.DefaultLogger.Debug(fmt.Sprintf("Skipping %v for field %s of type %s", val, field.Name, field.Type()))
+		return
+	}
+	field.SetConcrete(row, val)
+}
+
+//  Return the records with the computed fields that match the filter, with the selected fields,
+//  aggregated into buckets, and the seconds since the last uplink if requested
+func apply_options(records []record, opts FrameOptions) []record {
+	records = computeFields(records, opts.Computed)
+	records = filterRecords(records, opts.Filter)
+	records = select_records(records, with_computed(opts.Fields, opts.Computed))
+	records = aggregateRecords(records, opts.Aggregation, opts.Interval)
+	if opts.SinceLastUplink {
+		records = withSinceLastUplink(records, opts.Now)
+	}
+	return records
+}
+
+//  Return the selected fields with the computed fields that weren't selected.
+//  No fields are returned if none are selected, since all fields are included.
+func with_computed(fields []FieldSelection, computed []ComputedField) []FieldSelection {
+	if len(fields) == 0 || len(computed) == 0 {
+		return fields
+	}
+	selected := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		selected[f.Name] = true
+	}
+	all := append([]FieldSelection{}, fields...)
+	for _, c := range computed {
+		if !selected[c.Name] {
+			all = append(all, FieldSelection{Name: c.Name})
+		}
+	}
+	return all
+}
+
+//  Return the records with only the selected fields in the body, so that the
+//  other fields are never materialised. The labels are kept.
+func select_records(records []record, fields []FieldSelection) []record {
+	if len(fields) == 0 {
+		return records
+	}
+	selected := make([]record, 0, len(records))
+	for _, r := range records {
+		body := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			if val, ok := r.body[f.Name]; ok {
+				body[f.Name] = val
+			}
+		}
+		r.body = body
+		selected = append(selected, r)
+	}
+	return selected
+}
+
+//  Order the fields of the Data Frame as selected and apply the aliases and units, which
+//  take precedence over the device profiles. The Time field stays first, and fields that weren't selected (like the label columns) go last.
+func select_fields(frame *data.Frame, fields []FieldSelection) *data.Frame {
+	if frame == nil || len(frame.Fields) < 2 || len(fields) == 0 {
+		return frame
+	}
+	position := make(map[string]int, len(fields))
+	for idx, f := range fields {
+		if _, ok := position[f.Name]; !ok {
+			position[f.Name] = idx
+		}
+	}
+	rank := func(field *data.Field) int {
+		if idx, ok := position[field.Name]; ok {
+			return idx
+		}
+		return len(fields)
+	}
+	values := frame.Fields[1:]
+	sort.SliceStable(values, func(i, j int) bool { return rank(values[i]) < rank(values[j]) })
+
+	for _, field := range values {
+		idx, ok := position[field.Name]
+		if !ok {
+			continue
+		}
+		f := fields[idx]
+		if f.Unit != "" {
+			if field.Config == nil {
+				field.Config = &data.FieldConfig{}
+			}
+			field.Config.Unit = f.Unit
+		}
+		if f.Alias != "" {
+			field.Name = f.Alias
+			if field.Config != nil {
+				field.Config.DisplayNameFromDS = ""
+			}
+		}
+	}
+	return frame
+}
+
+//  Return an empty Data Frame with the notices of the payload formatters, or the decode error if none
+func decode_error_frame(topic string, err error, notices []data.Notice) *data.Frame {
+	if len(notices) == 0 {
+		return set_error(data.NewFrame(topic), err)
+	}
+	return set_notices(data.NewFrame(topic), notices)
+}
+
+//  Append the notices to the Data Frame
+func set_notices(frame *data.Frame, notices []data.Notice) *data.Frame {
+	if len(notices) > 0 {
+		frame.AppendNotices(notices...)
+	}
+	return frame
+}
+
 //  Return the Data Frame set to the given error
 func set_error(frame *data.Frame, err error) *data.Frame {
 	frame.AppendNotices(data.Notice{
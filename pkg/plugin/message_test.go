@@ -1,10 +1,13 @@
 package plugin_test
 
 import (
+	"encoding/base64"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/mqtt-datasource/pkg/mqtt"
 	"github.com/grafana/mqtt-datasource/pkg/plugin"
 	"github.com/stretchr/testify/require"
@@ -52,3 +55,150 @@ func TestJSONValuesMessage(t *testing.T) {
 		require.Equal(t, val, v)
 	}
 }
+
+// uplink returns a TTN uplink message for the device with the CBOR encoded body.
+func uplink(t *testing.T, device string, body map[string]interface{}) string {
+	payload, err := cbor.Marshal(body)
+	require.NoError(t, err)
+	return fmt.Sprintf(`{
+		"end_device_ids": {
+			"device_id": %q,
+			"application_ids": {"application_id": "luppy-application"},
+			"dev_eui": "70B3D57ED0045669",
+			"join_eui": "0000000000000000"
+		},
+		"uplink_message": {"f_port": 2, "frm_payload": %q}
+	}`, device, base64.StdEncoding.EncodeToString(payload))
+}
+
+// deviceLabels returns the labels of a device sent by uplink.
+func deviceLabels(device string) data.Labels {
+	return data.Labels{
+		"device_id":      device,
+		"application_id": "luppy-application",
+		"dev_eui":        "70B3D57ED0045669",
+		"join_eui":       "0000000000000000",
+	}
+}
+
+func TestDeviceLabels(t *testing.T) {
+	frame := plugin.ToFrame("all", []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234, "l": 1000})},
+		{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 2345, "l": 2000})},
+	})
+	require.Equal(t, []string{"Time", "l", "t"}, fieldNames(frame))
+	require.Nil(t, frame.Fields[0].Labels)
+	require.Equal(t, deviceLabels("tank-1"), frame.Fields[1].Labels)
+	require.Equal(t, deviceLabels("tank-1"), frame.Fields[2].Labels)
+}
+
+func TestFrameLayouts(t *testing.T) {
+	messages := []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})},
+		{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-2", map[string]interface{}{"t": 2345})},
+		{Timestamp: time.Unix(3, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 3456})},
+	}
+
+	t.Run("long", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{})
+		require.Len(t, frames, 1)
+		require.Equal(t, 3, frames[0].Rows())
+		require.Equal(t, []string{"Time", "application_id", "dev_eui", "device_id", "join_eui", "t"}, fieldNames(frames[0]))
+	})
+
+	t.Run("perDevice", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Layout: plugin.FrameLayoutPerDevice})
+		require.Len(t, frames, 2)
+		require.Equal(t, "tank-1", frames[0].Name)
+		require.Equal(t, 2, frames[0].Rows())
+		require.Equal(t, []string{"Time", "t"}, fieldNames(frames[0]))
+		require.Equal(t, deviceLabels("tank-1"), frames[0].Fields[1].Labels)
+		require.Equal(t, "tank-2", frames[1].Name)
+		require.Equal(t, 1, frames[1].Rows())
+	})
+
+	t.Run("wide", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Layout: plugin.FrameLayoutWide})
+		require.Len(t, frames, 1)
+		frame := frames[0]
+		require.Equal(t, 3, frame.Rows())
+		require.Len(t, frame.Fields, 3)
+		require.Equal(t, deviceLabels("tank-1"), frame.Fields[1].Labels)
+		require.Equal(t, deviceLabels("tank-2"), frame.Fields[2].Labels)
+
+		v, ok := frame.Fields[1].ConcreteAt(2)
+		require.True(t, ok)
+		require.Equal(t, 3456.0, v)
+		_, ok = frame.Fields[2].ConcreteAt(2)
+		require.False(t, ok)
+	})
+}
+
+func TestMixedNumbers(t *testing.T) {
+	// CBOR decodes 5 to uint64, -3 to int64 and 2.5 to float64
+	messages := []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 5})},
+		{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": -3})},
+		{Timestamp: time.Unix(3, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 2.5})},
+		{Timestamp: time.Unix(4, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": uint64(7)})},
+	}
+
+	for _, layout := range []plugin.FrameLayout{plugin.FrameLayoutLong, plugin.FrameLayoutPerDevice, plugin.FrameLayoutWide} {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Layout: layout})
+		require.Len(t, frames, 1, layout)
+		field := fieldByName(frames[0], "t")
+		require.NotNil(t, field, layout)
+		require.Equal(t, data.FieldTypeNullableFloat64, field.Type(), layout)
+
+		values := make([]interface{}, field.Len())
+		for idx := range values {
+			values[idx], _ = field.ConcreteAt(idx)
+		}
+		require.Equal(t, []interface{}{5.0, -3.0, 2.5, 7.0}, values, layout)
+	}
+}
+
+func TestFieldSelection(t *testing.T) {
+	messages := []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234, "l": 1000, "h": 50})},
+		{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-2", map[string]interface{}{"t": 2345, "l": 2000, "h": 60})},
+	}
+	fields := []plugin.FieldSelection{
+		{Name: "t", Alias: "temperature", Unit: "celsius"},
+		{Name: "l"},
+		{Name: "missing"},
+	}
+
+	t.Run("long", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Fields: fields})
+		require.Len(t, frames, 1)
+		require.Equal(t, []string{"Time", "temperature", "l", "application_id", "dev_eui", "device_id", "join_eui"}, fieldNames(frames[0]))
+		require.Equal(t, "celsius", frames[0].Fields[1].Config.Unit)
+		require.Nil(t, frames[0].Fields[2].Config)
+	})
+
+	t.Run("perDevice", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Layout: plugin.FrameLayoutPerDevice, Fields: fields})
+		require.Len(t, frames, 2)
+		for _, frame := range frames {
+			require.Equal(t, []string{"Time", "temperature", "l"}, fieldNames(frame))
+			require.Equal(t, "celsius", frame.Fields[1].Config.Unit)
+		}
+	})
+
+	t.Run("values", func(t *testing.T) {
+		frames := plugin.ToFrames("test/data", []mqtt.Message{{Timestamp: time.Unix(1, 0), Value: "1"}},
+			plugin.FrameOptions{Fields: []plugin.FieldSelection{{Name: "Value", Alias: "level", Unit: "percent"}}})
+		require.Len(t, frames, 1)
+		require.Equal(t, []string{"Time", "level"}, fieldNames(frames[0]))
+		require.Equal(t, "percent", frames[0].Fields[1].Config.Unit)
+	})
+}
+
+func fieldNames(frame *data.Frame) []string {
+	names := make([]string, 0, len(frame.Fields))
+	for _, field := range frame.Fields {
+		names = append(names, field.Name)
+	}
+	return names
+}
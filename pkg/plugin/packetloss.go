@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+)
+
+// maxReorderedUplinks is the distance below the last frame counter of an uplink that
+// arrives late and fills a gap. A counter further below is a reset of the device.
+const maxReorderedUplinks = 16
+
+// frameCounters tracks the frame counters of the uplinks of a device.
+type frameCounters struct {
+	deviceID   string
+	devEUI     string
+	received   int64
+	missed     int64
+	duplicates int64
+	resets     int64
+
+	// session and counters of the current session
+	session string
+	first   uint64
+	last    uint64
+	seen    map[uint64]bool
+}
+
+// add counts an uplink with the frame counter. A counter that was already seen in the
+// session is a duplicate, a counter that skips ahead is a gap of missed uplinks, and a
+// counter slightly behind fills a gap with an uplink that arrived late. A counter that
+// goes further back, or a new session after a join, is a reset of the device.
+func (c *frameCounters) add(fCnt uint64, session string) {
+	switch {
+	case c.seen == nil:
+		// first uplink of the device in the time range
+	case session != c.session:
+		c.resets++
+		c.seen = nil
+	case c.seen[fCnt]:
+		c.duplicates++
+		return
+	case fCnt < c.last && fCnt > c.first && c.last-fCnt <= maxReorderedUplinks:
+		c.seen[fCnt] = true
+		c.missed--
+		c.received++
+		return
+	case fCnt < c.last:
+		c.resets++
+		c.seen = nil
+	case fCnt > c.last+1:
+		c.missed += int64(fCnt - c.last - 1)
+	}
+
+	if c.seen == nil {
+		c.seen = make(map[uint64]bool)
+		c.first = fCnt
+	}
+	c.seen[fCnt] = true
+	c.session = session
+	c.last = fCnt
+	c.received++
+}
+
+// lossPercent returns the percentage of uplinks missed, of the uplinks sent.
+func (c *frameCounters) lossPercent() float64 {
+	sent := c.received + c.missed
+	if sent == 0 {
+		return 0
+	}
+	return float64(c.missed) * 100 / float64(sent)
+}
+
+// packetLossFrame analyses the frame counters of the uplinks in the time range and
+// returns a frame with one row per device: the uplinks received, missed, duplicated,
+// the counter resets and the packet loss in percent. The duplicates dropped by the
+// deduplication of the client are added to the duplicates of the device.
+func packetLossFrame(name string, messages, duplicates []mqtt.Message, tr backend.TimeRange) *data.Frame {
+	type uplink struct {
+		mqtt.Message
+		ttnUplink
+	}
+	uplinks := make([]uplink, 0, len(messages))
+	for _, m := range messages {
+		if !inTimeRange(m.Timestamp, tr) {
+			continue
+		}
+		var u ttnUplink
+		if err := json.Unmarshal([]byte(m.Value), &u); err != nil {
+			log.DefaultLogger.Debug(fmt.Sprintf("packetLossFrame: Decode error %s", err.Error()))
+			continue
+		}
+		if u.EndDeviceIDs.DeviceID == "" {
+			continue
+		}
+		uplinks = append(uplinks, uplink{Message: m, ttnUplink: u})
+	}
+	sort.SliceStable(uplinks, func(i, j int) bool {
+		return uplinks[i].Timestamp.Before(uplinks[j].Timestamp)
+	})
+
+	devices := make(map[string]*frameCounters)
+	for _, u := range uplinks {
+		ids := u.EndDeviceIDs
+		c, ok := devices[ids.DeviceID]
+		if !ok {
+			c = &frameCounters{deviceID: ids.DeviceID}
+			devices[ids.DeviceID] = c
+		}
+		if ids.DevEUI != "" {
+			c.devEUI = ids.DevEUI
+		}
+		c.add(u.UplinkMessage.FCnt, u.UplinkMessage.SessionKeyID)
+	}
+
+	for _, m := range duplicates {
+		if !inTimeRange(m.Timestamp, tr) {
+			continue
+		}
+		var u ttnUplink
+		if err := json.Unmarshal([]byte(m.Value), &u); err != nil {
+			continue
+		}
+		if c, ok := devices[u.EndDeviceIDs.DeviceID]; ok {
+			c.duplicates++
+		}
+	}
+
+	list := make([]*frameCounters, 0, len(devices))
+	for _, c := range devices {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].deviceID < list[j].deviceID
+	})
+
+	count := len(list)
+	deviceField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	deviceField.Name = "device_id"
+	devEUIField := data.NewFieldFromFieldType(data.FieldTypeString, count)
+	devEUIField.Name = "dev_eui"
+	receivedField := data.NewFieldFromFieldType(data.FieldTypeInt64, count)
+	receivedField.Name = "received"
+	missedField := data.NewFieldFromFieldType(data.FieldTypeInt64, count)
+	missedField.Name = "missed"
+	duplicatesField := data.NewFieldFromFieldType(data.FieldTypeInt64, count)
+	duplicatesField.Name = "duplicates"
+	resetsField := data.NewFieldFromFieldType(data.FieldTypeInt64, count)
+	resetsField.Name = "resets"
+	lossField := data.NewFieldFromFieldType(data.FieldTypeFloat64, count)
+	lossField.Name = "loss_percent"
+	lossField.Config = &data.FieldConfig{Unit: "percent"}
+
+	for row, c := range list {
+		deviceField.Set(row, c.deviceID)
+		devEUIField.Set(row, c.devEUI)
+		receivedField.Set(row, c.received)
+		missedField.Set(row, c.missed)
+		duplicatesField.Set(row, c.duplicates)
+		resetsField.Set(row, c.resets)
+		lossField.Set(row, c.lossPercent())
+	}
+
+	return data.NewFrame(name, deviceField, devEUIField, receivedField, missedField, duplicatesField, resetsField, lossField)
+}
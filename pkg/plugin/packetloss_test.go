@@ -0,0 +1,87 @@
+package plugin_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketLoss(t *testing.T) {
+	counter := func(at int64, device string, fCnt int, session string) mqtt.Message {
+		return mqtt.Message{
+			Timestamp: time.Unix(at, 0),
+			Value: fmt.Sprintf(`{"end_device_ids": {"device_id": %q}, "uplink_message": {"session_key_id": %q, "f_cnt": %d, "frm_payload": "oWF0GQTS"}}`,
+				device, session, fCnt),
+		}
+	}
+	client := &fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"all": {
+				// out of the time range
+				counter(10, "tank-1", 1, "A"),
+				// 2, 3, 6: 4 and 5 missed
+				counter(100, "tank-1", 2, "A"),
+				counter(110, "tank-1", 3, "A"),
+				counter(120, "tank-1", 6, "A"),
+				// duplicate
+				counter(121, "tank-1", 6, "A"),
+				// reboot: counter goes back
+				counter(130, "tank-1", 0, "A"),
+				counter(140, "tank-1", 1, "A"),
+				// rejoin: new session
+				counter(150, "tank-1", 5, "B"),
+				// no loss
+				counter(100, "tank-2", 7, "C"),
+				counter(110, "tank-2", 8, "C"),
+				// reordered: 3 arrives after 4
+				counter(100, "tank-3", 1, "D"),
+				counter(110, "tank-3", 2, "D"),
+				counter(120, "tank-3", 4, "D"),
+				counter(121, "tank-3", 3, "D"),
+				counter(130, "tank-3", 5, "D"),
+				{Timestamp: time.Unix(120, 0), Value: `{"plain": "json"}`},
+			},
+		},
+		duplicates: map[string][]mqtt.Message{
+			"all": {
+				// out of the time range
+				counter(11, "tank-1", 1, "A"),
+				// dropped by the deduplication
+				counter(122, "tank-1", 6, "A"),
+			},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	res := ds.Query(backend.DataQuery{
+		QueryType: "packetLoss",
+		JSON:      []byte(`{}`),
+		TimeRange: backend.TimeRange{From: time.Unix(50, 0), To: time.Unix(1000, 0)},
+	})
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 1)
+
+	frame := res.Frames[0]
+	require.Equal(t, 3, frame.Rows())
+	column := func(name string) []interface{} {
+		field := fieldByName(frame, name)
+		require.NotNil(t, field, name)
+		values := make([]interface{}, field.Len())
+		for idx := range values {
+			values[idx] = field.At(idx)
+		}
+		return values
+	}
+	require.Equal(t, []interface{}{"tank-1", "tank-2", "tank-3"}, column("device_id"))
+	require.Equal(t, []interface{}{int64(6), int64(2), int64(5)}, column("received"))
+	require.Equal(t, []interface{}{int64(2), int64(0), int64(0)}, column("missed"))
+	require.Equal(t, []interface{}{int64(2), int64(0), int64(0)}, column("duplicates"))
+	require.Equal(t, []interface{}{int64(2), int64(0), int64(0)}, column("resets"))
+	require.Equal(t, []interface{}{float64(25), float64(0), float64(0)}, column("loss_percent"))
+}
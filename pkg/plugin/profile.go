@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// DeviceProfile describes the decoded fields of a type of device, so panels
+// show display names and units without overrides.
+type DeviceProfile struct {
+	Name string `json:"name"`
+	// Regular expression for the IDs of the devices with the profile. All devices if empty.
+	DeviceID string `json:"deviceId,omitempty"`
+	// Metadata of the decoded fields, by field name.
+	Fields map[string]FieldProfile `json:"fields"`
+
+	deviceID *regexp.Regexp
+}
+
+// FieldProfile is the display metadata of a decoded field.
+type FieldProfile struct {
+	DisplayName string   `json:"displayName,omitempty"`
+	Unit        string   `json:"unit,omitempty"`
+	Decimals    *uint16  `json:"decimals,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+}
+
+// UnmarshalJSON decodes the profile and compiles its device ID pattern, which matches the whole ID.
+func (p *DeviceProfile) UnmarshalJSON(b []byte) error {
+	type profile DeviceProfile
+	if err := json.Unmarshal(b, (*profile)(p)); err != nil {
+		return err
+	}
+	p.deviceID = nil
+	if p.DeviceID == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + p.DeviceID + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid device ID pattern for profile %s: %w", p.Name, err)
+	}
+	p.deviceID = re
+	return nil
+}
+
+// lookupProfile returns the metadata of the field for the device, from the first profile
+// of the device that describes the field. If the device is unknown, e.g. a frame with
+// several devices, the first profile describing the field is used.
+func lookupProfile(profiles []DeviceProfile, device, field string) (FieldProfile, bool) {
+	for _, p := range profiles {
+		if device != "" && p.deviceID != nil && !p.deviceID.MatchString(device) {
+			continue
+		}
+		if fp, ok := p.Fields[field]; ok {
+			return fp, true
+		}
+	}
+	return FieldProfile{}, false
+}
+
+// applyProfiles sets the config of the value fields of the frame from the profiles.
+// The device is taken from the device_id label of each field. Since the display name
+// replaces the naming by labels, the device is added to the display name of labelled
+// fields, so the series of several devices can be told apart.
+func applyProfiles(frame *data.Frame, profiles []DeviceProfile) *data.Frame {
+	if frame == nil || len(profiles) == 0 || len(frame.Fields) < 2 {
+		return frame
+	}
+	for _, field := range frame.Fields[1:] {
+		device := field.Labels["device_id"]
+		fp, ok := lookupProfile(profiles, device, field.Name)
+		if !ok {
+			continue
+		}
+		if field.Config == nil {
+			field.Config = &data.FieldConfig{}
+		}
+		if fp.DisplayName != "" {
+			field.Config.DisplayNameFromDS = fp.DisplayName
+			if device != "" {
+				field.Config.DisplayNameFromDS = fp.DisplayName + " " + device
+			}
+		}
+		if fp.Unit != "" {
+			field.Config.Unit = fp.Unit
+		}
+		if fp.Decimals != nil {
+			field.Config.SetDecimals(*fp.Decimals)
+		}
+		if fp.Min != nil {
+			field.Config.SetMin(*fp.Min)
+		}
+		if fp.Max != nil {
+			field.Config.SetMax(*fp.Max)
+		}
+	}
+	return frame
+}
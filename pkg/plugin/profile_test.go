@@ -0,0 +1,81 @@
+package plugin_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceProfiles(t *testing.T) {
+	var profiles []plugin.DeviceProfile
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"name": "tank", "deviceId": "tank-.*", "fields": {
+			"t": {"displayName": "Temperature", "unit": "celsius", "decimals": 1, "min": -40, "max": 85},
+			"l": {"displayName": "Level", "unit": "percent"}
+		}},
+		{"name": "default", "fields": {
+			"t": {"displayName": "Temp"}
+		}}
+	]`), &profiles))
+
+	messages := []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234, "l": 50})},
+		{Timestamp: time.Unix(2, 0), Value: uplink(t, "pump-1", map[string]interface{}{"t": 2345})},
+	}
+
+	t.Run("per device", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages, plugin.FrameOptions{Layout: plugin.FrameLayoutPerDevice, Profiles: profiles})
+		require.Len(t, frames, 2)
+
+		pump, tank := frames[0], frames[1]
+		require.Equal(t, []string{"Time", "t"}, fieldNames(pump))
+		require.Equal(t, &data.FieldConfig{DisplayNameFromDS: "Temp pump-1"}, pump.Fields[1].Config)
+
+		require.Equal(t, []string{"Time", "l", "t"}, fieldNames(tank))
+		require.Equal(t, &data.FieldConfig{DisplayNameFromDS: "Level tank-1", Unit: "percent"}, tank.Fields[1].Config)
+		config := (&data.FieldConfig{DisplayNameFromDS: "Temperature tank-1", Unit: "celsius"}).SetDecimals(1).SetMin(-40).SetMax(85)
+		require.Equal(t, config, tank.Fields[2].Config)
+	})
+
+	tanks := []mqtt.Message{
+		{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})},
+		{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-2", map[string]interface{}{"t": 2345})},
+	}
+
+	t.Run("devices of the same profile per device", func(t *testing.T) {
+		frames := plugin.ToFrames("all", tanks, plugin.FrameOptions{Layout: plugin.FrameLayoutPerDevice, Profiles: profiles})
+		require.Len(t, frames, 2)
+		require.Equal(t, "Temperature tank-1", frames[0].Fields[1].Config.DisplayNameFromDS)
+		require.Equal(t, "Temperature tank-2", frames[1].Fields[1].Config.DisplayNameFromDS)
+	})
+
+	t.Run("devices of the same profile in the wide layout", func(t *testing.T) {
+		frames := plugin.ToFrames("all", tanks, plugin.FrameOptions{Layout: plugin.FrameLayoutWide, Profiles: profiles})
+		require.Len(t, frames, 1)
+		require.Equal(t, []string{"Time", "t", "t"}, fieldNames(frames[0]))
+		require.Equal(t, "Temperature tank-1", frames[0].Fields[1].Config.DisplayNameFromDS)
+		require.Equal(t, "Temperature tank-2", frames[0].Fields[2].Config.DisplayNameFromDS)
+	})
+
+	t.Run("query options take precedence", func(t *testing.T) {
+		frames := plugin.ToFrames("all", messages[:1], plugin.FrameOptions{
+			Profiles: profiles,
+			Fields:   []plugin.FieldSelection{{Name: "t", Alias: "temperature", Unit: "fahrenheit"}},
+		})
+		require.Len(t, frames, 1)
+		field := frames[0].Fields[1]
+		require.Equal(t, "temperature", field.Name)
+		require.Equal(t, "fahrenheit", field.Config.Unit)
+		require.Empty(t, field.Config.DisplayNameFromDS)
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		var profiles []plugin.DeviceProfile
+		require.Error(t, json.Unmarshal([]byte(`[{"name": "tank", "deviceId": "tank-("}]`), &profiles))
+	})
+}
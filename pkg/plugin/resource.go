@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+)
+
+// observedDevice is a device seen in the buffered uplinks.
+type observedDevice struct {
+	DeviceID      string          `json:"device_id"`
+	DevEUI        string          `json:"dev_eui,omitempty"`
+	ApplicationID string          `json:"application_id,omitempty"`
+	JoinEUI       string          `json:"join_eui,omitempty"`
+	Uplinks       int             `json:"uplinks"`
+	LastSeen      time.Time       `json:"last_seen"`
+	Fields        []observedField `json:"fields"`
+}
+
+// observedField is a field decoded from the uplinks of a device.
+type observedField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// newResourceHandler returns the handler for the resource endpoints used by the query editor:
+//
+//	/topics              MQTT topics seen on the broker
+//	/devices             devices seen in the buffered uplinks
+//	/fields?device_id=x  fields decoded for the device, or for all devices
+func newResourceHandler(ds *MQTTDatasource) backend.CallResourceHandler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topics", ds.handleTopics)
+	mux.HandleFunc("/devices", ds.handleDevices)
+	mux.HandleFunc("/fields", ds.handleFields)
+	return httpadapter.New(mux)
+}
+
+func (ds *MQTTDatasource) handleTopics(rw http.ResponseWriter, _ *http.Request) {
+	writeJSON(rw, ds.Client.ObservedTopics())
+}
+
+func (ds *MQTTDatasource) handleDevices(rw http.ResponseWriter, _ *http.Request) {
+	writeJSON(rw, ds.observedDevices())
+}
+
+func (ds *MQTTDatasource) handleFields(rw http.ResponseWriter, req *http.Request) {
+	device := req.URL.Query().Get("device_id")
+
+	types := make(map[string]string)
+	for _, d := range ds.observedDevices() {
+		if device != "" && d.DeviceID != device {
+			continue
+		}
+		for _, field := range d.Fields {
+			if _, ok := types[field.Name]; !ok {
+				types[field.Name] = field.Type
+			}
+		}
+	}
+
+	fields := make([]observedField, 0, len(types))
+	for name, typ := range types {
+		fields = append(fields, observedField{Name: name, Type: typ})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	writeJSON(rw, fields)
+}
+
+// observedDevices returns the devices in the buffered uplinks. The uplinks stay
+// subscribed for the grace period, so the editor sees new devices as they appear.
+func (ds *MQTTDatasource) observedDevices() []observedDevice {
+	ds.Client.Subscribe(mqtt.DefaultTopic)
+	defer ds.Client.Unsubscribe(mqtt.DefaultTopic)
+
+	messages, ok := ds.Client.Messages(mqtt.DefaultTopic)
+	if !ok || len(messages) == 0 {
+		return []observedDevice{}
+	}
+	records, err := decodeMessages(messages, ds.Settings.Decoders)
+	if err != nil {
+		log.DefaultLogger.Debug(fmt.Sprintf("observedDevices: %s", err.Error()))
+		return []observedDevice{}
+	}
+	return observeDevices(records)
+}
+
+// observeDevices summarises the records by device, sorted by device ID.
+func observeDevices(records []record) []observedDevice {
+	devices := make(map[string]*observedDevice)
+	fields := make(map[string]map[string]string)
+	for _, r := range records {
+		id := r.labels["device_id"]
+		device, ok := devices[id]
+		if !ok {
+			device = &observedDevice{
+				DeviceID:      id,
+				DevEUI:        r.labels["dev_eui"],
+				ApplicationID: r.labels["application_id"],
+				JoinEUI:       r.labels["join_eui"],
+			}
+			devices[id] = device
+			fields[id] = make(map[string]string)
+		}
+		device.Uplinks++
+		if r.timestamp.After(device.LastSeen) {
+			device.LastSeen = r.timestamp
+		}
+		for key, val := range r.body {
+			if _, ok := fields[id][key]; ok {
+				continue
+			}
+			if typ := get_type(val); typ != data.FieldTypeUnknown {
+				fields[id][key] = typ.NonNullableType().ItemTypeString()
+			}
+		}
+	}
+
+	list := make([]observedDevice, 0, len(devices))
+	for id, device := range devices {
+		for name, typ := range fields[id] {
+			device.Fields = append(device.Fields, observedField{Name: name, Type: typ})
+		}
+		sort.Slice(device.Fields, func(i, j int) bool { return device.Fields[i].Name < device.Fields[j].Name })
+		list = append(list, *device)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceID < list[j].DeviceID })
+	return list
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(body)
+}
@@ -0,0 +1,91 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/grafana/mqtt-datasource/pkg/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallResource(t *testing.T) {
+	client := &fakeMQTTClient{
+		connected: true,
+		messages: map[string][]mqtt.Message{
+			"all": {
+				{Timestamp: time.Unix(1, 0), Value: uplink(t, "tank-2", map[string]interface{}{"l": 1000})},
+				{Timestamp: time.Unix(2, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 1234})},
+				{Timestamp: time.Unix(3, 0), Value: uplink(t, "tank-1", map[string]interface{}{"t": 2345, "ok": true})},
+			},
+		},
+		observed: []mqtt.ObservedTopic{
+			{Topic: "v3/luppy-application@ttn/devices/tank-1/up", Messages: 2, LastSeen: time.Unix(3, 0)},
+		},
+	}
+	ds := plugin.NewMQTTDatasource(client, "xyz")
+
+	call := func(t *testing.T, url string, v interface{}) {
+		sender := &fakeResourceSender{}
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+			Method: http.MethodGet,
+			Path:   strings.SplitN(url, "?", 2)[0],
+			URL:    url,
+		}, sender)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, sender.response.Status)
+		require.NoError(t, json.Unmarshal(sender.response.Body, v))
+	}
+
+	t.Run("topics", func(t *testing.T) {
+		var topics []mqtt.ObservedTopic
+		call(t, "topics", &topics)
+		require.Len(t, topics, 1)
+		require.Equal(t, uint64(2), topics[0].Messages)
+	})
+
+	t.Run("devices", func(t *testing.T) {
+		var devices []struct {
+			DeviceID string `json:"device_id"`
+			DevEUI   string `json:"dev_eui"`
+			Uplinks  int    `json:"uplinks"`
+			Fields   []struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"fields"`
+		}
+		call(t, "devices", &devices)
+		require.Len(t, devices, 2)
+		require.Equal(t, "tank-1", devices[0].DeviceID)
+		require.Equal(t, "70B3D57ED0045669", devices[0].DevEUI)
+		require.Equal(t, 2, devices[0].Uplinks)
+		require.Len(t, devices[0].Fields, 2)
+		require.Equal(t, "tank-2", devices[1].DeviceID)
+	})
+
+	t.Run("fields", func(t *testing.T) {
+		var fields []map[string]string
+		call(t, "fields?device_id=tank-1", &fields)
+		require.Equal(t, []map[string]string{
+			{"name": "ok", "type": "bool"},
+			{"name": "t", "type": "float64"},
+		}, fields)
+
+		call(t, "fields", &fields)
+		require.Len(t, fields, 3)
+	})
+}
+
+type fakeResourceSender struct {
+	response *backend.CallResourceResponse
+}
+
+func (s *fakeResourceSender) Send(response *backend.CallResourceResponse) error {
+	s.response = response
+	return nil
+}
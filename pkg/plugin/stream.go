@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+)
+
+// liveStream sends frames to a Grafana Live stream with a stable schema.
+// Grafana Live resets the panel whenever the schema of a pushed frame changes,
+// so every frame is widened to the fields seen so far on the stream, and only
+// the data is sent unless a new field has to be added to the schema.
+type liveStream struct {
+	query   queryModel
+	options FrameOptions
+	sender  *backend.StreamSender
+
+	// schema holds the fields sent so far, time field first.
+	schema []*data.Field
+	// index maps a field key (name and labels) to its position in schema.
+	index map[string]int
+
+	// uplinks holds the last uplink of each device sent on the stream, for the heartbeats.
+	uplinks map[string]*lastUplink
+}
+
+func newLiveStream(qm queryModel, opts FrameOptions, sender *backend.StreamSender) *liveStream {
+	return &liveStream{
+		query:   qm,
+		options: opts,
+		sender:  sender,
+		index:   make(map[string]int),
+		uplinks: make(map[string]*lastUplink),
+	}
+}
+
+// seen records an uplink of the device sent on the stream.
+func (s *liveStream) seen(labels data.Labels, at time.Time) {
+	s.uplinks[labels.String()] = &lastUplink{labels: labels, at: at}
+}
+
+// seed records the last buffered uplink of each device that matches the filter of the
+// stream, so the devices that went quiet before the stream started get heartbeats too.
+func (s *liveStream) seed(messages []mqtt.Message) {
+	records, _, err := decodeMessagesWithNotices(messages, s.options.Decoders)
+	if err != nil {
+		log.DefaultLogger.Debug(fmt.Sprintf("stream: seeding heartbeats: %s", err.Error()))
+		return
+	}
+	records = filterRecords(computeFields(records, s.options.Computed), s.options.Filter)
+	for _, r := range records {
+		if r.labels == nil {
+			continue
+		}
+		if last, ok := s.uplinks[r.labels.String()]; !ok || r.timestamp.After(last.at) {
+			s.seen(r.labels, r.timestamp)
+		}
+	}
+}
+
+// heartbeat pushes the seconds since the last uplink of each device seen on the stream,
+// so panels show the silence of a device instead of freezing on its last value.
+func (s *liveStream) heartbeat(now time.Time) error {
+	if len(s.uplinks) == 0 {
+		return nil
+	}
+	records := sinceLastUplinkRecords(s.uplinks, now)
+	for _, frame := range recordFrames(s.query.Topic, records, s.options) {
+		if frame.Rows() == 0 {
+			continue
+		}
+		if err := s.send(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send pushes the rows of the frame to the stream.
+func (s *liveStream) send(frame *data.Frame) error {
+	if frame == nil || len(frame.Fields) == 0 {
+		log.DefaultLogger.Debug("stream: skipping frame without fields")
+		return nil
+	}
+
+	changed := s.update(frame)
+	out := s.widen(frame)
+
+	include := data.IncludeDataOnly
+	if changed {
+		include = data.IncludeAll
+	}
+	return s.sender.SendFrame(out, include)
+}
+
+// update adds the fields of the frame that are not in the schema yet.
+// Returns true if the schema changed.
+func (s *liveStream) update(frame *data.Frame) bool {
+	changed := false
+	for idx, field := range frame.Fields {
+		key := fieldKey(idx, field)
+		if _, ok := s.index[key]; ok {
+			continue
+		}
+		typ := field.Type()
+		if idx > 0 {
+			typ = typ.NullableType()
+		}
+		schemaField := data.NewFieldFromFieldType(typ, 0)
+		schemaField.Name = field.Name
+		schemaField.Labels = field.Labels.Copy()
+		schemaField.Config = field.Config
+		s.index[key] = len(s.schema)
+		s.schema = append(s.schema, schemaField)
+		changed = true
+	}
+	return changed
+}
+
+// widen returns a frame with the schema of the stream and the rows of the frame.
+// Fields that are missing in the frame are null, numbers are set as float64.
+func (s *liveStream) widen(frame *data.Frame) *data.Frame {
+	rows := frame.Rows()
+	out := data.NewFrame(frame.Name)
+	out.Meta = frame.Meta
+	for _, schemaField := range s.schema {
+		field := data.NewFieldFromFieldType(schemaField.Type(), rows)
+		field.Name = schemaField.Name
+		field.Labels = schemaField.Labels
+		field.Config = schemaField.Config
+		out.Fields = append(out.Fields, field)
+	}
+
+	for idx, field := range frame.Fields {
+		outField := out.Fields[s.index[fieldKey(idx, field)]]
+		for row := 0; row < rows; row++ {
+			if val, ok := field.ConcreteAt(row); ok {
+				set_value(outField, row, val)
+			}
+		}
+	}
+	return out
+}
+
+// fieldKey identifies a field in the schema. The first field is the time field.
+func fieldKey(idx int, field *data.Field) string {
+	if idx == 0 {
+		return "\x00time"
+	}
+	return field.Name + field.Labels.String()
+}
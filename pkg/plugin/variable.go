@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// variableQueryPattern matches a variable query, e.g. devices(), fields(tank-1) or fields("tank-1").
+var variableQueryPattern = regexp.MustCompile(`^\s*(\w+)\s*\(\s*(.*?)\s*\)\s*$`)
+
+// variableQuery is a template variable query: a function and its optional argument.
+type variableQuery struct {
+	function string
+	arg      string
+}
+
+// parseVariableQuery parses a variable query:
+//
+//	devices()         device IDs
+//	fields()          names of the fields decoded for all devices
+//	fields(device)    names of the fields decoded for the device
+//	gateways()        IDs of the gateways that received the uplinks
+func parseVariableQuery(text string) (variableQuery, error) {
+	match := variableQueryPattern.FindStringSubmatch(text)
+	if match == nil {
+		return variableQuery{}, fmt.Errorf("invalid variable query %q: expected devices(), fields(device) or gateways()", text)
+	}
+
+	q := variableQuery{
+		function: match[1],
+		arg:      strings.Trim(match[2], `"'`),
+	}
+	switch q.function {
+	case "devices", "gateways":
+		if q.arg != "" {
+			return q, fmt.Errorf("invalid variable query %q: %s() takes no argument", text, q.function)
+		}
+	case "fields":
+	default:
+		return q, fmt.Errorf("invalid variable query %q: unknown function %s", text, q.function)
+	}
+	return q, nil
+}
+
+// variableFrame returns a single-column frame with the sorted values of the variable query.
+func variableFrame(q variableQuery, records []record) *data.Frame {
+	var name string
+	values := make(map[string]struct{})
+
+	switch q.function {
+	case "devices":
+		name = "device_id"
+		for _, r := range records {
+			if id := r.labels["device_id"]; id != "" {
+				values[id] = struct{}{}
+			}
+		}
+
+	case "fields":
+		name = "field"
+		for _, device := range observeDevices(records) {
+			if q.arg != "" && device.DeviceID != q.arg {
+				continue
+			}
+			for _, field := range device.Fields {
+				values[field.Name] = struct{}{}
+			}
+		}
+
+	case "gateways":
+		name = "gateway_id"
+		for _, r := range records {
+			for _, rx := range r.uplink.UplinkMessage.RxMetadata {
+				if id := rx.GatewayIDs.GatewayID; id != "" {
+					values[id] = struct{}{}
+				}
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(values))
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+	sort.Strings(sorted)
+
+	return data.NewFrame(q.function, data.NewField(name, nil, sorted))
+}
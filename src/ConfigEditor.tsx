@@ -1,18 +1,46 @@
-import React, { ChangeEvent } from 'react';
-import { Form, Field, FieldSet, Input } from '@grafana/ui';
+import React, { ChangeEvent, useState } from 'react';
+import { Form, Field, FieldSet, Input, Select, Switch, TextArea } from '@grafana/ui';
 import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
 import { MqttDataSourceOptions, MqttSecureJsonData } from './types';
 import { handlerFactory } from './handleEvent';
 
 interface Props extends DataSourcePluginOptionsEditorProps<MqttDataSourceOptions, MqttSecureJsonData> {}
 
+interface JsonFieldProps<T> {
+  label: string;
+  description: string;
+  value?: T;
+  onChange: (value?: T) => void;
+}
+
+// JsonField edits a JSON setting, applied when the text area loses focus.
+const JsonField = <T,>({ label, description, value, onChange }: JsonFieldProps<T>) => {
+  const [text, setText] = useState(value ? JSON.stringify(value, null, 2) : '');
+  const [error, setError] = useState<string>();
+
+  const onBlur = () => {
+    try {
+      onChange(text.trim() ? JSON.parse(text) : undefined);
+      setError(undefined);
+    } catch (e) {
+      setError(`Invalid JSON: ${e instanceof Error ? e.message : e}`);
+    }
+  };
+
+  return (
+    <Field label={label} description={description} invalid={!!error} error={error}>
+      <TextArea rows={8} value={text} css="" onChange={(event) => setText(event.currentTarget.value)} onBlur={onBlur} />
+    </Field>
+  );
+};
+
 export const ConfigEditor = (props: Props) => {
   const {
     onOptionsChange,
     options,
     options: { jsonData, secureJsonData, secureJsonFields },
   } = props;
-  const { host, port, username } = jsonData;
+  const { host, port, username, gracePeriod, deduplicationWindow, enableDownlinks, downlinkRole, decoders, profiles } = jsonData;
 
   // const { password } = (secureJsonData ?? {}) as MqttSecureJsonData;
   const handleChange = handlerFactory(options, onOptionsChange);
@@ -66,6 +94,34 @@ export const ConfigEditor = (props: Props) => {
                 onChange={handleChange('jsonData.port', Number)}
               />
             </Field>
+            <Field
+              label="Grace period (seconds)"
+              description="How long a topic stays subscribed after its last query or stream ends"
+            >
+              <Input
+                type="number"
+                name="gracePeriod"
+                value={gracePeriod}
+                placeholder="600"
+                css=""
+                autoComplete="off"
+                onChange={handleChange('jsonData.gracePeriod', Number)}
+              />
+            </Field>
+            <Field
+              label="Deduplication window (seconds)"
+              description="Drop messages received again within the window, e.g. from another broker. 0 disables it"
+            >
+              <Input
+                type="number"
+                name="deduplicationWindow"
+                value={deduplicationWindow}
+                placeholder="60"
+                css=""
+                autoComplete="off"
+                onChange={handleChange('jsonData.deduplicationWindow', Number)}
+              />
+            </Field>
           </FieldSet>
 
           <FieldSet label="Authentication">
@@ -96,6 +152,52 @@ export const ConfigEditor = (props: Props) => {
               />
             </Field>
           </FieldSet>
+
+          <FieldSet label="Downlinks">
+            <Field label="Enable downlinks" description="Allow publishing downlinks to ds/<uid>/downlink">
+              <Switch
+                value={enableDownlinks ?? false}
+                css=""
+                onChange={(event) =>
+                  onOptionsChange({
+                    ...options,
+                    jsonData: { ...jsonData, enableDownlinks: event.currentTarget.checked },
+                  })
+                }
+              />
+            </Field>
+            <Field label="Minimum role" description="Grafana role required to publish downlinks">
+              <Select
+                options={[
+                  { label: 'Viewer', value: 'Viewer' },
+                  { label: 'Editor', value: 'Editor' },
+                  { label: 'Admin', value: 'Admin' },
+                ]}
+                value={downlinkRole ?? 'Editor'}
+                onChange={(v) =>
+                  onOptionsChange({
+                    ...options,
+                    jsonData: { ...jsonData, downlinkRole: v.value },
+                  })
+                }
+              />
+            </Field>
+          </FieldSet>
+
+          <FieldSet label="Devices">
+            <JsonField
+              label="Decoders"
+              description='Decoder of the payloads by f_port, device ID or DevEUI range, CBOR by default, e.g. [{"fPort": 1, "decoder": "lpp"}]'
+              value={decoders}
+              onChange={(value) => onOptionsChange({ ...options, jsonData: { ...jsonData, decoders: value } })}
+            />
+            <JsonField
+              label="Profiles"
+              description='Display name, unit, decimals, min and max of the decoded fields, e.g. [{"name": "tank", "deviceId": "tank-.*", "fields": {"t": {"displayName": "Temperature", "unit": "celsius"}}}]'
+              value={profiles}
+              onChange={(value) => onOptionsChange({ ...options, jsonData: { ...jsonData, profiles: value } })}
+            />
+          </FieldSet>
         </>
       )}
     </Form>
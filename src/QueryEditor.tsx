@@ -1,29 +1,253 @@
-import React from 'react';
-import { Form, Field, Input } from '@grafana/ui';
-import { QueryEditorProps } from '@grafana/data';
+import React, { useEffect, useState } from 'react';
+import { Button, Form, Field, HorizontalGroup, IconButton, Input, Select, Switch } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { DataSource } from './datasource';
-import { MqttDataSourceOptions, MqttQuery } from './types';
+import {
+  AggregateFunc,
+  ComputedField,
+  FieldSelection,
+  FrameLayout,
+  MqttDataSourceOptions,
+  MqttQuery,
+  ObservedField,
+  QueryType,
+} from './types';
 import { handlerFactory } from 'handleEvent';
 
 type Props = QueryEditorProps<DataSource, MqttQuery, MqttDataSourceOptions>;
 
+const queryTypeOptions: Array<SelectableValue<QueryType | ''>> = [
+  { label: 'Uplinks', value: '', description: 'Decoded uplink messages' },
+  { label: 'Downlink status', value: 'downlinks', description: 'Lifecycle of each downlink' },
+  { label: 'Joins', value: 'joins', description: 'Join-accepts of the devices' },
+  { label: 'Device activity', value: 'activity', description: 'Last uplink and uplink count of each device' },
+  { label: 'Packet loss', value: 'packetLoss', description: 'Missed, duplicated and reset frame counters of each device' },
+  { label: 'Locations', value: 'locations', description: 'Last location of each device, for the Geomap panel' },
+];
+
+const layoutOptions: Array<SelectableValue<FrameLayout>> = [
+  { label: 'Long', value: 'long', description: 'Single frame' },
+  { label: 'Per device', value: 'perDevice', description: 'One frame per device' },
+  { label: 'Wide', value: 'wide', description: 'One field per device, labelled by the device' },
+];
+
+const aggregateOptions: Array<SelectableValue<AggregateFunc | ''>> = [
+  { label: 'None', value: '', description: 'Raw uplinks' },
+  { label: 'Mean', value: 'mean' },
+  { label: 'Min', value: 'min' },
+  { label: 'Max', value: 'max' },
+  { label: 'Last', value: 'last' },
+  { label: 'Count', value: 'count' },
+  { label: 'Sum', value: 'sum' },
+];
+
 export const QueryEditor = (props: Props) => {
-  const { query, onChange } = props;
+  const { datasource, query, onChange } = props;
   const handleEvent = handlerFactory(query, onChange);
+  const fields = query.fields ?? [];
+
+  const setFields = (next: FieldSelection[]) => onChange({ ...query, fields: next.length ? next : undefined });
+  const setField = (idx: number, change: Partial<FieldSelection>) =>
+    setFields(fields.map((f, i) => (i === idx ? { ...f, ...change } : f)));
+  const computed = query.computed ?? [];
+  const setComputed = (next: ComputedField[]) => onChange({ ...query, computed: next.length ? next : undefined });
+  const setComputedField = (idx: number, change: Partial<ComputedField>) =>
+    setComputed(computed.map((c, i) => (i === idx ? { ...c, ...change } : c)));
+
+  // Devices and fields seen in the buffered uplinks, for the field pickers
+  const [devices, setDevices] = useState<Array<SelectableValue<string>>>([]);
+  const [device, setDevice] = useState<string>();
+  const [observedFields, setObservedFields] = useState<ObservedField[]>([]);
+  useEffect(() => {
+    datasource
+      .getDevices()
+      .then((list) => setDevices(list.map((d) => ({ label: d.device_id, value: d.device_id, description: d.dev_eui }))))
+      .catch(() => setDevices([]));
+  }, [datasource]);
+  useEffect(() => {
+    datasource
+      .getFields(device)
+      .then(setObservedFields)
+      .catch(() => setObservedFields([]));
+  }, [datasource, device]);
+  const fieldOptions: Array<SelectableValue<string>> = observedFields.map((f) => ({
+    label: f.name,
+    value: f.name,
+    description: f.type,
+  }));
+  const fieldOption = (name: string): SelectableValue<string> | null =>
+    name ? fieldOptions.find((o) => o.value === name) ?? { label: name, value: name } : null;
 
   return (
     <Form onSubmit={() => {}}>
       {() => (
-        <Field label="Topic (only 'all' is supported)">
-          <Input
-            name="queryText"
-            required
-            value={query.queryText}
-            css=""
-            autoComplete="off"
-            onChange={handleEvent('queryText')}
-          />
-        </Field>
+        <>
+          <Field label="Query type">
+            <Select
+              options={queryTypeOptions}
+              value={query.queryType ?? ''}
+              onChange={(v) => onChange({ ...query, queryType: v.value || undefined })}
+            />
+          </Field>
+          {query.queryType === 'locations' && (
+            <Field label="Gateways" description="Also return the locations of the gateways">
+              <Switch
+                value={query.gateways ?? false}
+                onChange={(e) => onChange({ ...query, gateways: e.currentTarget.checked || undefined })}
+              />
+            </Field>
+          )}
+          <Field label="Topic (only 'all' is supported)">
+            <Input
+              name="queryText"
+              required
+              value={query.queryText}
+              css=""
+              autoComplete="off"
+              onChange={handleEvent('queryText')}
+            />
+          </Field>
+          <Field label="Layout">
+            <Select
+              options={layoutOptions}
+              value={query.layout ?? 'long'}
+              onChange={(v) => onChange({ ...query, layout: v.value })}
+            />
+          </Field>
+          <Field label="Computed fields" description="e.g. temperature = t / 100, evaluated on every uplink">
+            <>
+              {computed.map((c, idx) => (
+                <HorizontalGroup key={idx}>
+                  <Input
+                    placeholder="Name"
+                    value={c.name}
+                    css=""
+                    onChange={(e) => setComputedField(idx, { name: e.currentTarget.value })}
+                  />
+                  <Input
+                    placeholder="Expression"
+                    value={c.expression}
+                    css=""
+                    onChange={(e) => setComputedField(idx, { expression: e.currentTarget.value })}
+                  />
+                  <IconButton name="trash-alt" onClick={() => setComputed(computed.filter((_, i) => i !== idx))} />
+                </HorizontalGroup>
+              ))}
+              <Button
+                variant="secondary"
+                icon="plus"
+                type="button"
+                onClick={() => setComputed([...computed, { name: '', expression: '' }])}
+              >
+                Add computed field
+              </Button>
+            </>
+          </Field>
+          <Field label="Filter" description='e.g. device_id =~ "tank-.*" AND battery < 3.3'>
+            <Input
+              name="filter"
+              value={query.filter ?? ''}
+              css=""
+              autoComplete="off"
+              onChange={(e) => onChange({ ...query, filter: e.currentTarget.value || undefined })}
+            />
+          </Field>
+          <Field
+            label="Seconds since last uplink"
+            description="Add the silence of each device. Streams send it every heartbeat, even without messages"
+          >
+            <HorizontalGroup>
+              <Switch
+                value={query.sinceLastUplink ?? false}
+                onChange={(e) => onChange({ ...query, sinceLastUplink: e.currentTarget.checked || undefined })}
+              />
+              {query.sinceLastUplink && (
+                <Input
+                  type="number"
+                  placeholder="Heartbeat (seconds): 10"
+                  value={query.heartbeat ?? ''}
+                  css=""
+                  onChange={(e) => onChange({ ...query, heartbeat: Number(e.currentTarget.value) || undefined })}
+                />
+              )}
+            </HorizontalGroup>
+          </Field>
+          <Field
+            label="Stale after"
+            description="Alert rules: seconds the last value of a device is kept when it didn't send in the time range"
+          >
+            <Input
+              type="number"
+              placeholder="3600"
+              value={query.staleAfter ?? ''}
+              css=""
+              onChange={(e) => onChange({ ...query, staleAfter: Number(e.currentTarget.value) || undefined })}
+            />
+          </Field>
+          <Field label="Aggregate" description="Downsample into buckets of the query interval">
+            <HorizontalGroup>
+              <Select
+                options={aggregateOptions}
+                value={query.aggregation?.function ?? ''}
+                onChange={(v) =>
+                  onChange({ ...query, aggregation: v.value ? { ...query.aggregation, function: v.value } : undefined })
+                }
+              />
+              {query.aggregation && (
+                <Switch
+                  label="Group by device"
+                  value={query.aggregation.groupByDevice ?? false}
+                  onChange={(e) =>
+                    onChange({
+                      ...query,
+                      aggregation: { ...query.aggregation, groupByDevice: e.currentTarget.checked },
+                    })
+                  }
+                />
+              )}
+            </HorizontalGroup>
+          </Field>
+          <Field label="Device" description="Offer the fields of the device, or of all devices if empty">
+            <Select
+              options={devices}
+              value={device ?? null}
+              isClearable
+              placeholder="All devices"
+              onChange={(v) => setDevice(v?.value || undefined)}
+            />
+          </Field>
+          <Field label="Fields" description="Fields to include, with optional alias and unit. All fields if empty.">
+            <>
+              {fields.map((f, idx) => (
+                <HorizontalGroup key={idx}>
+                  <Select
+                    options={fieldOptions}
+                    value={fieldOption(f.name)}
+                    placeholder="Field"
+                    allowCustomValue
+                    onChange={(v) => setField(idx, { name: v?.value ?? '' })}
+                  />
+                  <Input
+                    placeholder="Alias"
+                    value={f.alias ?? ''}
+                    css=""
+                    onChange={(e) => setField(idx, { alias: e.currentTarget.value || undefined })}
+                  />
+                  <Input
+                    placeholder="Unit"
+                    value={f.unit ?? ''}
+                    css=""
+                    onChange={(e) => setField(idx, { unit: e.currentTarget.value || undefined })}
+                  />
+                  <IconButton name="trash-alt" onClick={() => setFields(fields.filter((_, i) => i !== idx))} />
+                </HorizontalGroup>
+              ))}
+              <Button variant="secondary" icon="plus" type="button" onClick={() => setFields([...fields, { name: '' }])}>
+                Add field
+              </Button>
+            </>
+          </Field>
+        </>
       )}
     </Form>
   );
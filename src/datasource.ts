@@ -1,9 +1,42 @@
-import { DataSourceInstanceSettings } from '@grafana/data';
-import { DataSourceWithBackend } from '@grafana/runtime';
-import { MqttDataSourceOptions, MqttQuery } from './types';
+import { DataFrame, DataQueryRequest, DataSourceInstanceSettings, MetricFindValue, ScopedVars } from '@grafana/data';
+import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
+import { MqttDataSourceOptions, MqttQuery, ObservedDevice, ObservedField } from './types';
 
 export class DataSource extends DataSourceWithBackend<MqttQuery, MqttDataSourceOptions> {
   constructor(instanceSettings: DataSourceInstanceSettings<MqttDataSourceOptions>) {
     super(instanceSettings);
   }
+
+  // Dashboard variables, e.g. $device, can be used in the topic, filter, computed fields and fields
+  applyTemplateVariables(query: MqttQuery, scopedVars: ScopedVars): MqttQuery {
+    const replace = (value?: string) => (value ? getTemplateSrv().replace(value, scopedVars) : value);
+    return {
+      ...query,
+      queryText: replace(query.queryText),
+      filter: replace(query.filter),
+      computed: query.computed?.map((c) => ({ ...c, expression: replace(c.expression) ?? '' })),
+      fields: query.fields?.map((f) => ({ ...f, name: replace(f.name) ?? '', alias: replace(f.alias) })),
+    };
+  }
+
+  // Variable queries: devices(), fields(device) or gateways()
+  async metricFindQuery(query: string, options?: any): Promise<MetricFindValue[]> {
+    const request = {
+      ...options,
+      targets: [{ refId: 'variable', queryType: 'variable', queryText: query }],
+    } as DataQueryRequest<MqttQuery>;
+    const response = await this.query(request).toPromise();
+    const frame = response.data[0] as DataFrame | undefined;
+    const values: string[] = frame?.fields[0]?.values.toArray() ?? [];
+    return values.map((text) => ({ text }));
+  }
+
+  // Devices and fields seen in the buffered uplinks, for the query editor
+  getDevices(): Promise<ObservedDevice[]> {
+    return this.getResource('devices');
+  }
+
+  getFields(deviceId?: string): Promise<ObservedField[]> {
+    return this.getResource('fields', deviceId ? { device_id: deviceId } : undefined);
+  }
 }
@@ -1,16 +1,101 @@
 import { DataQuery, DataSourceJsonData } from '@grafana/data';
 
+export type QueryType = 'downlinks' | 'variable' | 'joins' | 'activity' | 'packetLoss' | 'locations';
+
+export type FrameLayout = 'long' | 'perDevice' | 'wide';
+
+export interface FieldSelection {
+  name: string;
+  alias?: string;
+  unit?: string;
+}
+
+export interface ComputedField {
+  name: string;
+  expression: string;
+}
+
+export type AggregateFunc = 'mean' | 'min' | 'max' | 'last' | 'count' | 'sum';
+
+export interface Aggregation {
+  function?: AggregateFunc;
+  fields?: Record<string, AggregateFunc>;
+  groupByDevice?: boolean;
+}
+
 export interface MqttQuery extends DataQuery {
   queryText?: string;
   stream?: boolean;
+  layout?: FrameLayout;
+  fields?: FieldSelection[];
+  computed?: ComputedField[];
+  filter?: string;
+  aggregation?: Aggregation;
+  gateways?: boolean;
+  sinceLastUplink?: boolean;
+  heartbeat?: number;
+  staleAfter?: number;
 }
 
 export interface MqttDataSourceOptions extends DataSourceJsonData {
   host: string;
   port: number;
   username?: string;
+  gracePeriod?: number;
+  deduplicationWindow?: number;
+  enableDownlinks?: boolean;
+  downlinkRole?: 'Viewer' | 'Editor' | 'Admin';
+  decoders?: DecoderRule[];
+  profiles?: DeviceProfile[];
+}
+
+export interface StructField {
+  name?: string;
+  type: 'uint8' | 'int8' | 'uint16' | 'int16' | 'uint32' | 'int32' | 'uint64' | 'int64' | 'float32' | 'float64';
+  scale?: number;
+}
+
+export interface DecoderRule {
+  fPort?: number;
+  deviceId?: string;
+  devEuiFrom?: string;
+  devEuiTo?: string;
+  decoder: 'cbor' | 'lpp' | 'struct' | 'decoded_payload' | 'javascript';
+  layout?: StructField[];
+  byteOrder?: 'big' | 'little';
+  script?: string;
+  timeout?: number;
+}
+
+export interface FieldProfile {
+  displayName?: string;
+  unit?: string;
+  decimals?: number;
+  min?: number;
+  max?: number;
+}
+
+export interface DeviceProfile {
+  name: string;
+  deviceId?: string;
+  fields: Record<string, FieldProfile>;
 }
 
 export interface MqttSecureJsonData {
   password?: string;
 }
+
+export interface ObservedField {
+  name: string;
+  type: string;
+}
+
+export interface ObservedDevice {
+  device_id: string;
+  dev_eui?: string;
+  application_id?: string;
+  join_eui?: string;
+  uplinks: number;
+  last_seen: string;
+  fields: ObservedField[];
+}